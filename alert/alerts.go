@@ -0,0 +1,80 @@
+package alert
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Alert is a condition that an experiment has seen and not yet seen clear,
+// such as corrupt payloads from one particular peer.
+type Alert struct {
+	Name    string    `json:"name"`
+	Subject string    `json:"subject"`
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+	Count   int       `json:"count"`
+}
+
+type Board interface {
+	Raise(logger lager.Logger, name, subject, message string)
+	Clear(logger lager.Logger, name, subject string)
+	Snapshot() []Alert
+}
+
+func NewBoard() Board {
+	return &board{
+		lock:   &sync.Mutex{},
+		alerts: make(map[key]*Alert),
+	}
+}
+
+type key struct {
+	name    string
+	subject string
+}
+
+type board struct {
+	lock   *sync.Mutex
+	alerts map[key]*Alert
+}
+
+func (b *board) Raise(logger lager.Logger, name, subject, message string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	k := key{name, subject}
+	a, ok := b.alerts[k]
+	if !ok {
+		a = &Alert{Name: name, Subject: subject, Since: time.Now()}
+		b.alerts[k] = a
+		logger.Info("alert-raised", lager.Data{"alert": name, "subject": subject, "message": message})
+	}
+	a.Message = message
+	a.Count++
+}
+
+func (b *board) Clear(logger lager.Logger, name, subject string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	k := key{name, subject}
+	if _, ok := b.alerts[k]; ok {
+		delete(b.alerts, k)
+		logger.Info("alert-cleared", lager.Data{"alert": name, "subject": subject})
+	}
+}
+
+func (b *board) Snapshot() []Alert {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ret := make([]Alert, 0, len(b.alerts))
+	for _, a := range b.alerts {
+		ret = append(ret, *a)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Since.Before(ret[j].Since) })
+	return ret
+}
@@ -0,0 +1,76 @@
+// Package budget keeps experiment traffic within bounds: a Bucket caps how
+// fast bytes go out, and a Budget caps how many go out in an hour.
+package budget
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket of bytes.  It paces whole tests rather than
+// throttling the bytes inside them, so that a test still measures the path
+// and not the limit: each test runs flat out, takes what it sent, and the
+// next one waits until that has been paid for.
+type Bucket interface {
+	// Take counts n bytes as sent, going into debt if need be
+	Take(n int64)
+
+	// Wait blocks until the bucket is out of debt
+	Wait()
+}
+
+// NewBucket allows bytesPerSecond on average, in bursts of up to burst
+// bytes.  A zero rate allows anything.
+func NewBucket(bytesPerSecond float64, burst int64) Bucket {
+	if bytesPerSecond <= 0 {
+		return unlimited{}
+	}
+	return &bucket{
+		lock:   &sync.Mutex{},
+		rate:   bytesPerSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+type unlimited struct{}
+
+func (unlimited) Take(int64) {}
+
+func (unlimited) Wait() {}
+
+type bucket struct {
+	lock   *sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since last, up to burst.  Callers hold the
+// lock.
+func (b *bucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+func (b *bucket) Take(n int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+}
+
+func (b *bucket) Wait() {
+	b.lock.Lock()
+	b.refill()
+	debt := -b.tokens
+	b.lock.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / b.rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,128 @@
+package budget
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// window is how far back a Budget counts
+const window = time.Hour
+
+// Usage is what a Budget has seen over the past hour, by experiment.  An
+// experiment that has spent nothing for an hour stays in ByExperiment at
+// zero.  Remaining is only meaningful when there is a limit.  Denied counts every
+// run turned away since startup.
+type Usage struct {
+	BytesPerHour int64            `json:"bytes_per_hour"`
+	Used         int64            `json:"used"`
+	Remaining    int64            `json:"remaining"`
+	ByExperiment map[string]int64 `json:"by_experiment"`
+	Denied       map[string]int   `json:"denied"`
+}
+
+// Budget is a per-node allowance of experiment bytes per hour.  Experiments
+// ask it before sending and tell it what they actually sent afterwards.
+type Budget interface {
+	// Allow reports whether estimate more bytes fit in the past hour's
+	// budget.  An estimate of zero asks whether any budget is left.
+	Allow(logger lager.Logger, experiment string, estimate int64) bool
+	Spend(experiment string, n int64)
+	Usage() Usage
+}
+
+// NewBudget allows bytesPerHour, or anything when that is zero, and passes
+// the usage to report on every Allow and Spend
+func NewBudget(bytesPerHour int64, report func(Usage)) Budget {
+	return &ledger{
+		lock:         &sync.Mutex{},
+		bytesPerHour: bytesPerHour,
+		report:       report,
+		denied:       make(map[string]int),
+		seen:         make(map[string]bool),
+	}
+}
+
+type spend struct {
+	time       time.Time
+	experiment string
+	n          int64
+}
+
+type ledger struct {
+	lock         *sync.Mutex
+	bytesPerHour int64
+	report       func(Usage)
+	spends       []spend
+	denied       map[string]int
+	seen         map[string]bool
+}
+
+func (l *ledger) Allow(logger lager.Logger, experiment string, estimate int64) bool {
+	l.lock.Lock()
+	usage := l.usage()
+	allowed := l.bytesPerHour == 0 || usage.Remaining > 0 && estimate <= usage.Remaining
+	if !allowed {
+		l.denied[experiment]++
+		usage = l.usage()
+	}
+	l.lock.Unlock()
+
+	if !allowed {
+		logger.Info("over-budget", lager.Data{"experiment": experiment, "estimate": estimate, "remaining": usage.Remaining})
+	}
+	// reporting on every ask, not just every spend, lets spending that has
+	// aged out show up even when nothing is being sent
+	l.report(usage)
+	return allowed
+}
+
+func (l *ledger) Spend(experiment string, n int64) {
+	l.lock.Lock()
+	l.spends = append(l.spends, spend{time: time.Now(), experiment: experiment, n: n})
+	l.seen[experiment] = true
+	usage := l.usage()
+	l.lock.Unlock()
+
+	l.report(usage)
+}
+
+func (l *ledger) Usage() Usage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.usage()
+}
+
+// usage drops spends older than the window and totals the rest
+func (l *ledger) usage() Usage {
+	cutoff := time.Now().Add(-window)
+	i := 0
+	for i < len(l.spends) && l.spends[i].time.Before(cutoff) {
+		i++
+	}
+	l.spends = l.spends[i:]
+
+	u := Usage{
+		BytesPerHour: l.bytesPerHour,
+		ByExperiment: make(map[string]int64),
+		Denied:       make(map[string]int),
+	}
+	for experiment := range l.seen {
+		u.ByExperiment[experiment] = 0
+	}
+	for _, s := range l.spends {
+		u.Used += s.n
+		u.ByExperiment[s.experiment] += s.n
+	}
+	for k, v := range l.denied {
+		u.Denied[k] = v
+	}
+	if l.bytesPerHour > 0 {
+		u.Remaining = l.bytesPerHour - u.Used
+		if u.Remaining < 0 {
+			u.Remaining = 0
+		}
+	}
+	return u
+}
@@ -1,47 +1,79 @@
 package client
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
 
+	"github.com/rosenhouse/reflex/dnsquery"
 	"github.com/rosenhouse/reflex/peer"
 	"github.com/rosenhouse/reflex/science"
+	"github.com/rosenhouse/reflex/tcpinfo"
 )
 
 type Client struct {
-	HTTPClient *http.Client
-	Port       int
+	HTTPClient      *http.Client
+	FreshHTTPClient *http.Client
+	LoadHTTPClient  *http.Client
+	Port            int
+	Dial            DialOptions
 
 	ReportRoundTripLatency func(time.Duration)
+	ReportTiming           func(target string, timing Timing)
+
+	// leases holds the token of each lease held, by host
+	leases sync.Map
 }
 
-func (c *Client) doAndUnmarshal(method, url string, requestBody io.Reader, result interface{}) error {
-	req, err := http.NewRequest(method, url, requestBody)
+// do sends req with a connection-phase trace attached, hands the response
+// and the connection it came on to readBody and, if both succeed, reports
+// the timing against target.
+func (c *Client) do(httpClient *http.Client, target string, req *http.Request, readBody func(*http.Response, net.Conn) error) error {
+	t := &tracer{}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), t.clientTrace()))
+
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return err
 	}
-	resp, err := c.HTTPClient.Do(req)
+	defer resp.Body.Close()
+
+	if err := readBody(resp, t.conn); err != nil {
+		return err
+	}
+
+	c.ReportTiming(target, t.finish())
+	return nil
+}
+
+func (c *Client) doAndUnmarshal(target, method, url string, requestBody io.Reader, result interface{}) error {
+	req, err := http.NewRequest(method, url, requestBody)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	return json.NewDecoder(resp.Body).Decode(result)
+	return c.do(c.HTTPClient, target, req, func(resp *http.Response, _ net.Conn) error {
+		return json.NewDecoder(resp.Body).Decode(result)
+	})
 }
 
-func (c *Client) doPeerSync(logger lager.Logger, method, url string) ([]peer.Glimpse, error) {
+func (c *Client) doPeerSync(logger lager.Logger, target, method, url string) ([]peer.Glimpse, error) {
 	startTime := time.Now()
 
 	results := []peer.Glimpse{}
-	err := c.doAndUnmarshal(method, url, nil, &results)
+	err := c.doAndUnmarshal(target, method, url, nil, &results)
 	if err != nil {
 		return nil, err
 	}
@@ -56,34 +88,389 @@ func (c *Client) doPeerSync(logger lager.Logger, method, url string) ([]peer.Gli
 
 func (c *Client) ReadLeader(logger lager.Logger, leader string) ([]peer.Glimpse, error) {
 	url := fmt.Sprintf("http://%s/peers", leader)
-	return c.doPeerSync(logger, "GET", url)
+	return c.doPeerSync(logger, leader, "GET", url)
 }
 
 func (c *Client) PostAndReadSnapshot(logger lager.Logger, host string) ([]peer.Glimpse, error) {
 	url := fmt.Sprintf("http://%s:%d/peers", host, c.Port)
-	return c.doPeerSync(logger, "POST", url)
+	return c.doPeerSync(logger, host, "POST", url)
 }
 
-func (c *Client) TestBandwidth(logger lager.Logger, host string, payloadSize int64) (*science.BandwidthExperimentResult, error) {
-	url := fmt.Sprintf("http://%s:%d/bandwidth", host, c.Port)
+func (c *Client) Ping(logger lager.Logger, host string, fresh bool) (time.Duration, error) {
+	httpClient := c.HTTPClient
+	if fresh {
+		httpClient = c.FreshHTTPClient
+	}
+	return c.ping(httpClient, host, fmt.Sprintf("http://%s:%d", host, c.Port))
+}
 
-	localHasher := sha256.New()
-	payload := io.TeeReader(io.LimitReader(rand.Reader, payloadSize), localHasher)
-	results := &science.BandwidthExperimentResult{}
+// PingRoute is Ping through the platform router, which picks an instance
+func (c *Client) PingRoute(logger lager.Logger, route string) (time.Duration, error) {
+	return c.ping(c.HTTPClient, route, fmt.Sprintf("http://%s", route))
+}
+
+func (c *Client) ping(httpClient *http.Client, target, baseURL string) (time.Duration, error) {
+	req, err := http.NewRequest("GET", baseURL+"/echo", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	startTime := time.Now()
+	err = c.do(httpClient, target, req, func(resp *http.Response, _ net.Conn) error {
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(startTime), nil
+}
+
+// ExchangeTimestamps asks host for its clock, in the manner of NTP.  The
+// offset is how far host's clock is ahead of ours, and the delay is the
+// round trip less the time host spent answering.
+func (c *Client) ExchangeTimestamps(logger lager.Logger, host string) (science.ClockSample, error) {
+	url := fmt.Sprintf("http://%s:%d/clock", host, c.Port)
+
+	stamps := science.ClockTimestamps{}
+	originate := time.Now()
+	if err := c.doAndUnmarshal(host, "GET", url, nil, &stamps); err != nil {
+		return science.ClockSample{}, err
+	}
+	destination := time.Now()
+
+	t1, t2, t3, t4 := originate.UnixNano(), stamps.Receive, stamps.Transmit, destination.UnixNano()
+	return science.ClockSample{
+		Offset: time.Duration(((t2 - t1) + (t3 - t4)) / 2).Seconds(),
+		Delay:  time.Duration((t4 - t1) - (t3 - t2)).Seconds(),
+	}, nil
+}
+
+// ProbeHTTP GETs url on a fresh connection and returns the status
+func (c *Client) ProbeHTTP(logger lager.Logger, url string, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var status int
+	err = c.do(c.FreshHTTPClient, req.URL.Host, req, func(resp *http.Response, _ net.Conn) error {
+		status = resp.StatusCode
+		_, err := io.Copy(io.Discard, resp.Body)
+		return err
+	})
+	return status, err
+}
+
+// Resolve looks name up with the system resolver
+func (c *Client) Resolve(logger lager.Logger, name string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return net.DefaultResolver.LookupHost(ctx, name)
+}
+
+// LookupDNS resolves name through resolver, either science.ResolverSystem
+// or the address of a DNS server.  The system resolver does not give out
+// its response code, so that is inferred from the error.  Any code other
+// than NOERROR also comes back as an error.
+func (c *Client) LookupDNS(logger lager.Logger, resolver, name string, timeout time.Duration) (string, []string, error) {
+	if resolver == science.ResolverSystem {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		answers, err := net.DefaultResolver.LookupHost(ctx, name)
+		sort.Strings(answers)
+		return systemRcode(err), answers, err
+	}
+
+	var answers []string
+	for _, qtype := range []uint16{dnsquery.TypeA, dnsquery.TypeAAAA} {
+		resp, err := dnsquery.Exchange(resolver, name, qtype, timeout)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return "TIMEOUT", nil, err
+		} else if err != nil {
+			return "", nil, err
+		}
+		if rcode := dnsquery.RcodeName(resp.Rcode); resp.Rcode != 0 {
+			return rcode, nil, fmt.Errorf("%s from %s", rcode, resolver)
+		}
+		answers = append(answers, resp.Answers...)
+	}
+	sort.Strings(answers)
+	return dnsquery.RcodeName(0), answers, nil
+}
+
+func systemRcode(err error) string {
+	dnsErr, ok := err.(*net.DNSError)
+	switch {
+	case err == nil:
+		return dnsquery.RcodeName(0)
+	case !ok:
+		return ""
+	case dnsErr.IsNotFound:
+		return dnsquery.RcodeName(3)
+	case dnsErr.IsTimeout:
+		return "TIMEOUT"
+	}
+	return dnsquery.RcodeName(2)
+}
+
+// ReadDNSResults fetches a peer's latest DNS results
+func (c *Client) ReadDNSResults(logger lager.Logger, host string) ([]*science.DNSResult, error) {
+	url := fmt.Sprintf("http://%s:%d/dns/latest", host, c.Port)
+	results := []*science.DNSResult{}
+	err := c.doAndUnmarshal(host, "GET", url, nil, &results)
+	return results, err
+}
+
+// LoadEcho POSTs requestSize bytes to host's echo endpoint and asks for
+// responseSize back, returning how many arrived.  Unlike Ping it leaves out
+// the phase trace, which would swamp the metrics at load test rates.
+func (c *Client) LoadEcho(logger lager.Logger, host string, requestSize, responseSize int, timeout time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s:%d/echo?size=%d", host, c.Port, responseSize)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(make([]byte, requestSize)))
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.LoadHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return n, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return n, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return n, nil
+}
+
+// Connect opens a TCP connection to address and closes it straight away
+func (c *Client) Connect(logger lager.Logger, address string, timeout time.Duration) error {
+	conn, err := c.Dial.dialer(net.Dialer{Timeout: timeout}).Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
 
-	logger.Debug("starting", lager.Data{"payload": payloadSize})
-	err := c.doAndUnmarshal("POST", url, payload, results)
+func (c *Client) TestBandwidth(logger lager.Logger, host string, spec science.BandwidthSpec) (*science.BandwidthExperimentResult, error) {
+	return c.upload(logger, host, fmt.Sprintf("http://%s:%d", host, c.Port), host, spec)
+}
+
+// TestRouteBandwidth is TestBandwidth through the platform router.  It
+// carries the lease held on host, so that the test is admitted if the
+// router lands it there.
+func (c *Client) TestRouteBandwidth(logger lager.Logger, route, host string, spec science.BandwidthSpec) (*science.BandwidthExperimentResult, error) {
+	return c.upload(logger, route, fmt.Sprintf("http://%s", route), host, spec)
+}
+
+func (c *Client) upload(logger lager.Logger, target, baseURL, leased string, spec science.BandwidthSpec) (*science.BandwidthExperimentResult, error) {
+	spec.Seed = rand.Uint64()
+	url := fmt.Sprintf("%s/bandwidth?%s", baseURL, spec.Query().Encode())
+
+	body := spec.Limit(science.NewPayload(spec.Seed, spec.Kind))
+	if spec.Encoding == science.EncodingGzip {
+		body = science.Compress(body)
+	}
+	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
 		return nil, err
 	}
+	c.presentLease(req, leased)
+	if spec.Encoding != "" {
+		req.Header.Set("Content-Encoding", spec.Encoding)
+	}
 
-	localSHA256Sum := hex.EncodeToString(localHasher.Sum(nil))
-	if localSHA256Sum != results.SHA256 {
-		err := fmt.Errorf("sha mismatch")
-		logger.Error("invalid-result", err, lager.Data{"local-sha256": localSHA256Sum, "remote-result": results})
+	results := &science.BandwidthExperimentResult{}
+
+	logger.Debug("starting", lager.Data{"spec": spec})
+	err = c.do(c.HTTPClient, target, req, func(resp *http.Response, conn net.Conn) error {
+		if err := bandwidthStatus(resp); err != nil {
+			return err
+		}
+		if err := json.NewDecoder(resp.Body).Decode(results); err != nil {
+			return err
+		}
+		results.ClientTCPInfo = readTCPInfo(logger, conn)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
 	logger.Debug("complete")
 	return results, nil
 }
+
+// bandwidthStatus turns a peer's refusal into science.ErrBusy
+func bandwidthStatus(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusServiceUnavailable:
+		return science.ErrBusy
+	default:
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// AcquireLease asks host to serve no other node's bandwidth tests for up to
+// ttl.  A host that predates leases is taken to have granted it.
+func (c *Client) AcquireLease(logger lager.Logger, host string, ttl time.Duration) error {
+	url := fmt.Sprintf("http://%s:%d/bandwidth/lease?ttl=%s", host, c.Port, ttl)
+	resp, err := c.HTTPClient.Post(url, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(io.Discard, resp.Body)
+		logger.Debug("lease-unsupported", lager.Data{"host": host})
+		return nil
+	}
+	if err := bandwidthStatus(resp); err != nil {
+		io.Copy(io.Discard, resp.Body)
+		return err
+	}
+
+	var lease struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return err
+	}
+	c.leases.Store(host, lease.Token)
+	return nil
+}
+
+// presentLease adds the token of the lease held on host to req, if any
+func (c *Client) presentLease(req *http.Request, host string) {
+	if token, ok := c.leases.Load(host); ok && token != "" {
+		req.Header.Set(science.LeaseHeader, token.(string))
+	}
+}
+
+func (c *Client) ReleaseLease(logger lager.Logger, host string) error {
+	url := fmt.Sprintf("http://%s:%d/bandwidth/lease", host, c.Port)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	c.presentLease(req, host)
+	c.leases.Delete(host)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *Client) TestDownload(logger lager.Logger, host string, spec science.BandwidthSpec) (*science.BandwidthExperimentResult, error) {
+	spec.Seed = rand.Uint64()
+	url := fmt.Sprintf("http://%s:%d/bandwidth?%s", host, c.Port, spec.Query().Encode())
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.presentLease(req, host)
+
+	// asking for an encoding ourselves stops the transport from quietly
+	// decompressing, so that wire bytes can be counted
+	if spec.Encoding != "" {
+		req.Header.Set("Accept-Encoding", spec.Encoding)
+	}
+
+	verifier := science.NewPayloadVerifier(spec.Seed, spec.Kind)
+	result := &science.BandwidthExperimentResult{
+		Transport: science.TransportHTTP,
+		Direction: science.DirectionDownload,
+		Kind:      spec.Kind,
+	}
+
+	logger.Debug("starting-download", lager.Data{"spec": spec})
+	err = c.do(c.HTTPClient, host, req, func(resp *http.Response, conn net.Conn) error {
+		if err := bandwidthStatus(resp); err != nil {
+			return err
+		}
+
+		result.Protocol = resp.Proto
+		ramp := &science.RampRecorder{}
+		startTime := time.Now()
+
+		wire := &science.CountingReader{Reader: resp.Body}
+		var body io.Reader = wire
+		var err error
+		if result.Encoding = resp.Header.Get("Content-Encoding"); result.Encoding == science.EncodingGzip {
+			if body, err = gzip.NewReader(wire); err != nil {
+				return err
+			}
+		}
+
+		result.NumBytes, err = io.Copy(io.MultiWriter(verifier, ramp), body)
+		result.WireBytes = wire.N
+		if err != nil {
+			return err
+		}
+
+		result.DurationSeconds = time.Since(startTime).Seconds()
+		result.RampUp = ramp.Points()
+		result.AvgBandwidth = float64(result.NumBytes) / result.DurationSeconds
+		result.Integrity = verifier.Integrity
+
+		result.ClientTCPInfo = readTCPInfo(logger, conn)
+		if trailer := resp.Trailer.Get(science.ServerTCPInfoTrailer); trailer != "" {
+			result.ServerTCPInfo = &tcpinfo.Stats{}
+			if err := json.Unmarshal([]byte(trailer), result.ServerTCPInfo); err != nil {
+				logger.Error("parse-server-tcp-info", err)
+				result.ServerTCPInfo = nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("complete")
+	return result, nil
+}
+
+func readTCPInfo(logger lager.Logger, conn net.Conn) *tcpinfo.Stats {
+	var stats *tcpinfo.Stats
+	var err error
+	if sc, ok := conn.(*statsConn); ok {
+		stats, err = sc.tcpInfo()
+	} else {
+		stats, err = tcpinfo.Read(conn)
+	}
+	if err != nil {
+		logger.Debug("tcp-info-unavailable", lager.Data{"error": err.Error()})
+		return nil
+	}
+	return stats
+}
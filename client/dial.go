@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var ErrDialOptionsUnsupported = errors.New("TOS marking and interface binding are not supported on this platform")
+
+// DialOptions make experiment traffic look like a particular traffic class,
+// or leave by a particular route on a multi-homed host.  TOS, when set,
+// takes precedence over DSCP.
+type DialOptions struct {
+	DSCP          int    `json:"dscp,omitempty"`
+	TOS           int    `json:"tos,omitempty"`
+	SourceAddress string `json:"source_address,omitempty"`
+	Interface     string `json:"interface,omitempty"`
+}
+
+// Validate checks the options against this host
+func (o DialOptions) Validate() error {
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return fmt.Errorf("dscp %d out of range", o.DSCP)
+	}
+	if o.TOS < 0 || o.TOS > 255 {
+		return fmt.Errorf("tos %d out of range", o.TOS)
+	}
+	if !socketOptionsSupported && (o.tos() != 0 || o.Interface != "") {
+		return ErrDialOptionsUnsupported
+	}
+	if o.SourceAddress != "" && net.ParseIP(o.SourceAddress) == nil {
+		return fmt.Errorf("bad source address %q", o.SourceAddress)
+	}
+	if o.Interface != "" {
+		if _, err := net.InterfaceByName(o.Interface); err != nil {
+			return err
+		}
+	}
+	return o.probe()
+}
+
+// probe opens a socket with the options applied, so that a missing
+// privilege or a foreign source address shows up at startup rather than as
+// a failure on every dial
+func (o DialOptions) probe() error {
+	var lc net.ListenConfig
+	if o.tos() != 0 || o.Interface != "" {
+		lc.Control = o.control
+	}
+	address := ":0"
+	if o.SourceAddress != "" {
+		address = net.JoinHostPort(o.SourceAddress, "0")
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (o DialOptions) tos() int {
+	if o.TOS != 0 {
+		return o.TOS
+	}
+	return o.DSCP << 2
+}
+
+// Tag names the options for labelling results, or is empty when none are set
+func (o DialOptions) Tag() string {
+	var parts []string
+	switch {
+	case o.TOS != 0:
+		parts = append(parts, fmt.Sprintf("tos%d", o.TOS))
+	case o.DSCP != 0:
+		parts = append(parts, fmt.Sprintf("dscp%d", o.DSCP))
+	}
+	if o.SourceAddress != "" {
+		parts = append(parts, "src-"+o.SourceAddress)
+	}
+	if o.Interface != "" {
+		parts = append(parts, "if-"+o.Interface)
+	}
+	return strings.Join(parts, "_")
+}
+
+// dialer applies the options to a copy of base
+func (o DialOptions) dialer(base net.Dialer) *net.Dialer {
+	if o.SourceAddress != "" {
+		base.LocalAddr = &net.TCPAddr{IP: net.ParseIP(o.SourceAddress)}
+	}
+	if o.tos() != 0 || o.Interface != "" {
+		base.Control = o.control
+	}
+	return &base
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"strings"
+	"syscall"
+)
+
+const socketOptionsSupported = true
+
+func (o DialOptions) control(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if tos := o.tos(); tos != 0 {
+			level, option := syscall.IPPROTO_IP, syscall.IP_TOS
+			if strings.HasSuffix(network, "6") {
+				level, option = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+			}
+			if sockErr = syscall.SetsockoptInt(int(fd), level, option, tos); sockErr != nil {
+				return
+			}
+		}
+		if o.Interface != "" {
+			sockErr = syscall.BindToDevice(int(fd), o.Interface)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
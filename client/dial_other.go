@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import "syscall"
+
+const socketOptionsSupported = false
+
+func (o DialOptions) control(network, address string, c syscall.RawConn) error {
+	return ErrDialOptionsUnsupported
+}
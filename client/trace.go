@@ -0,0 +1,72 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"time"
+)
+
+// Timing breaks one request down by connection phase.  Phases that did not
+// happen are left zero: there is no DNS lookup for an IP literal, and no
+// dial or handshake at all when a kept-alive connection is reused.
+type Timing struct {
+	DNSLookup    time.Duration
+	TCPConnect   time.Duration
+	TLSHandshake time.Duration
+
+	// TimeToFirstByte runs from the request being fully written to the
+	// first byte of the response, so it covers one network round trip
+	// plus the time the target spent handling the request.
+	TimeToFirstByte time.Duration
+
+	// Transfer runs from the first byte of the response to the end of the body.
+	Transfer time.Duration
+
+	ReusedConn bool
+}
+
+type tracer struct {
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+
+	conn   net.Conn
+	timing Timing
+}
+
+func (t *tracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.timing.DNSLookup = time.Since(t.dnsStart) },
+
+		ConnectStart: func(string, string) { t.connectStart = time.Now() },
+		ConnectDone: func(string, string, error) {
+			t.timing.TCPConnect = time.Since(t.connectStart)
+		},
+
+		TLSHandshakeStart: func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.timing.TLSHandshake = time.Since(t.tlsStart)
+		},
+
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.conn = info.Conn
+			t.timing.ReusedConn = info.Reused
+		},
+
+		WroteRequest: func(httptrace.WroteRequestInfo) { t.wroteRequest = time.Now() },
+		GotFirstResponseByte: func() {
+			t.firstByte = time.Now()
+			t.timing.TimeToFirstByte = t.firstByte.Sub(t.wroteRequest)
+		},
+	}
+}
+
+// finish must be called once the response body has been consumed
+func (t *tracer) finish() Timing {
+	t.timing.Transfer = time.Since(t.firstByte)
+	return t.timing
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rosenhouse/reflex/tcpinfo"
+)
+
+// NewTransport returns a transport like http.DefaultTransport, except that
+// its connections hold on to their final TCP statistics when closed, and
+// are dialed with opts.
+func NewTransport(keepAlives bool, opts DialOptions) *http.Transport {
+	dialer := opts.dialer(net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	})
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &statsConn{Conn: conn}, nil
+		},
+		DisableKeepAlives:     !keepAlives,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// NewH2CTransport is NewTransport speaking only HTTP/2 without TLS, with
+// prior knowledge that the server understands it
+func NewH2CTransport(keepAlives bool, opts DialOptions) *http.Transport {
+	t := NewTransport(keepAlives, opts)
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t
+}
+
+// statsConn exists because the transport may close a connection the moment
+// a response body reaches EOF, before the caller has read its statistics.
+type statsConn struct {
+	net.Conn
+
+	lock   sync.Mutex
+	closed bool
+	final  *tcpinfo.Stats
+}
+
+func (c *statsConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.closed {
+		c.final, _ = tcpinfo.Read(c.Conn)
+		c.closed = true
+	}
+	return c.Conn.Close()
+}
+
+func (c *statsConn) tcpInfo() (*tcpinfo.Stats, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		if c.final == nil {
+			return nil, tcpinfo.ErrUnsupported
+		}
+		return c.final, nil
+	}
+	return tcpinfo.Read(c.Conn)
+}
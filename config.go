@@ -4,23 +4,73 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"code.cloudfoundry.org/lager"
+
+	"github.com/rosenhouse/reflex/client"
+	"github.com/rosenhouse/reflex/schedule"
+	"github.com/rosenhouse/reflex/science"
+	"github.com/rosenhouse/reflex/udpecho"
 )
 
 type Config struct {
 	Port         int
 	TTL          time.Duration
 	AllowedPeers *net.IPNet
+	RouterCIDR   *net.IPNet
 	CFInfo       struct {
 		URIs []string
 	}
-	Leader            string
-	LogLevel          lager.LogLevel
-	MetricMaxCapacity int
+	Leader               string
+	LogLevel             lager.LogLevel
+	MetricMaxCapacity    int
+	PingCount            int
+	BandwidthDirection   string
+	BandwidthStreams     int
+	BandwidthSizing      string
+	BandwidthDuration    time.Duration
+	MaxBandwidthDuration time.Duration
+	PayloadSize          int64
+	MaxPayloadSize       int64
+	DataPlanePort        int
+	PayloadKinds         []string
+	PayloadEncoding      string
+	Reachability         []science.ReachabilityTarget
+	ReachabilityPolicy   []science.ReachabilityRule
+	ReachabilityWorkers  int
+	ConnectTimeout       time.Duration
+	UDPPort              int
+	UDPTrainLength       int
+	UDPTrainInterval     time.Duration
+	UDPPacketSize        int
+	UDPTimeout           time.Duration
+	ExpectedPathMTU      int
+	MaxClockOffset       time.Duration
+	MaxClockDrift        float64
+	IdleMinGap           time.Duration
+	IdleMaxGap           time.Duration
+	ProbeTargets         []science.ProbeTarget
+	ProbeTimeout         time.Duration
+	DNSNames             []string
+	DNSResolvers         []string
+	DNSTimeout           time.Duration
+	LoadRate             float64
+	LoadConcurrency      int
+	LoadDuration         time.Duration
+	LoadRequestSize      int
+	LoadResponseSize     int
+	HTTP2Probes          bool
+	DialOptions          map[string]client.DialOptions
+	RateLimit            float64
+	RateLimitBurst       int64
+	BudgetBytesPerHour   int64
+	ScheduleWindows      map[string][]*schedule.Window
+	BandwidthLeaseTTL    time.Duration
+	CoveragePeriod       time.Duration
 }
 
 type element struct {
@@ -48,6 +98,15 @@ var elements = []element{
 			return
 		},
 	},
+	{
+		// X-Forwarded-For is only believed from here; empty trusts no one
+		"ROUTER_CIDR", "", func(c *Config, s string) (e error) {
+			if s != "" {
+				_, c.RouterCIDR, e = net.ParseCIDR(s)
+			}
+			return
+		},
+	},
 	{
 		"VCAP_APPLICATION", "{}", func(c *Config, s string) (e error) {
 			return json.Unmarshal([]byte(s), &c.CFInfo)
@@ -76,6 +135,447 @@ var elements = []element{
 			return
 		},
 	},
+	{
+		"PING_COUNT", "10", func(c *Config, s string) (e error) {
+			c.PingCount, e = strconv.Atoi(s)
+			if e == nil && c.PingCount < 1 {
+				e = fmt.Errorf("must be positive")
+			}
+			return
+		},
+	},
+	{
+		"BANDWIDTH_DIRECTION", "upload", func(c *Config, s string) (e error) {
+			switch s {
+			case science.DirectionUpload, science.DirectionDownload, science.DirectionBidirectional:
+				c.BandwidthDirection = s
+				return nil
+			}
+			return fmt.Errorf("unknown direction %q", s)
+		},
+	},
+	{
+		"BANDWIDTH_STREAMS", "1", func(c *Config, s string) (e error) {
+			c.BandwidthStreams, e = strconv.Atoi(s)
+			if e == nil && c.BandwidthStreams < 1 {
+				e = fmt.Errorf("need at least one stream")
+			}
+			return
+		},
+	},
+	{
+		"DATA_PLANE_PORT", "", func(c *Config, s string) (e error) {
+			if s != "" {
+				c.DataPlanePort, e = strconv.Atoi(s)
+			}
+			return
+		},
+	},
+	{
+		"PAYLOAD_KINDS", "random", func(c *Config, s string) (e error) {
+			c.PayloadKinds = nil
+			for _, kind := range strings.Split(s, ",") {
+				switch kind = strings.TrimSpace(kind); kind {
+				case science.PayloadRandom, science.PayloadPartial, science.PayloadCompressible:
+					c.PayloadKinds = append(c.PayloadKinds, kind)
+				default:
+					return fmt.Errorf("unknown payload kind %q", kind)
+				}
+			}
+			return
+		},
+	},
+	{
+		"PAYLOAD_ENCODING", "none", func(c *Config, s string) (e error) {
+			switch s {
+			case "none":
+				c.PayloadEncoding = ""
+			case science.EncodingGzip:
+				c.PayloadEncoding = s
+			default:
+				e = fmt.Errorf("unknown encoding %q", s)
+			}
+			return
+		},
+	},
+	{
+		"BANDWIDTH_SIZING", "fixed", func(c *Config, s string) (e error) {
+			switch s {
+			case science.SizingFixed, science.SizingDuration, science.SizingAdaptive:
+				c.BandwidthSizing = s
+				return nil
+			}
+			return fmt.Errorf("unknown sizing %q", s)
+		},
+	},
+	{
+		"BANDWIDTH_DURATION", "5s", func(c *Config, s string) (e error) {
+			c.BandwidthDuration, e = time.ParseDuration(s)
+			return
+		},
+	},
+	{
+		"MAX_BANDWIDTH_DURATION", "1m", func(c *Config, s string) (e error) {
+			c.MaxBandwidthDuration, e = time.ParseDuration(s)
+			if e == nil && c.MaxBandwidthDuration < c.BandwidthDuration {
+				e = fmt.Errorf("must be at least BANDWIDTH_DURATION")
+			}
+			return
+		},
+	},
+	{
+		"MAX_PAYLOAD_SIZE", "67108864", func(c *Config, s string) (e error) {
+			c.MaxPayloadSize, e = strconv.ParseInt(s, 10, 64)
+			return
+		},
+	},
+	{
+		"PAYLOAD_SIZE", "1048576", func(c *Config, s string) (e error) {
+			c.PayloadSize, e = strconv.ParseInt(s, 10, 64)
+			if e == nil && (c.PayloadSize < 1 || c.PayloadSize > c.MaxPayloadSize) {
+				e = fmt.Errorf("must be positive and at most MAX_PAYLOAD_SIZE")
+			}
+			return
+		},
+	},
+	{
+		"REACHABILITY_TARGETS", "", func(c *Config, s string) (e error) {
+			c.Reachability, e = science.ParseReachabilityTargets(s)
+			return
+		},
+	},
+	{
+		"REACHABILITY_POLICY", "", func(c *Config, path string) (e error) {
+			if path == "" {
+				return nil
+			}
+			data, e := os.ReadFile(path)
+			if e != nil {
+				return e
+			}
+			c.ReachabilityPolicy, e = science.ParseReachabilityPolicy(data)
+			return
+		},
+	},
+	{
+		"REACHABILITY_TIMEOUT", "2s", func(c *Config, s string) (e error) {
+			c.ConnectTimeout, e = time.ParseDuration(s)
+			return
+		},
+	},
+	{
+		"REACHABILITY_WORKERS", "32", func(c *Config, s string) (e error) {
+			c.ReachabilityWorkers, e = strconv.Atoi(s)
+			if e == nil && c.ReachabilityWorkers < 1 {
+				e = fmt.Errorf("need at least one worker")
+			}
+			return
+		},
+	},
+	{
+		"UDP_PORT", "", func(c *Config, s string) (e error) {
+			if s != "" {
+				c.UDPPort, e = strconv.Atoi(s)
+			}
+			return
+		},
+	},
+	{
+		"UDP_TRAIN_LENGTH", "50", func(c *Config, s string) (e error) {
+			c.UDPTrainLength, e = strconv.Atoi(s)
+			if e == nil && c.UDPTrainLength < 1 {
+				e = fmt.Errorf("need at least one datagram")
+			}
+			if e == nil && c.UDPTrainLength > udpecho.MaxTrainLength {
+				e = fmt.Errorf("must be at most %d", udpecho.MaxTrainLength)
+			}
+			return
+		},
+	},
+	{
+		"UDP_TRAIN_INTERVAL", "20ms", func(c *Config, s string) (e error) {
+			c.UDPTrainInterval, e = time.ParseDuration(s)
+			if e == nil && c.UDPTrainInterval <= 0 {
+				e = fmt.Errorf("interval must be positive")
+			}
+			return
+		},
+	},
+	{
+		"UDP_PACKET_SIZE", "172", func(c *Config, s string) (e error) {
+			c.UDPPacketSize, e = strconv.Atoi(s)
+			if e == nil && c.UDPPacketSize < udpecho.MinPacketSize {
+				e = fmt.Errorf("packets must be at least %d bytes", udpecho.MinPacketSize)
+			}
+			return
+		},
+	},
+	{
+		"UDP_TIMEOUT", "1s", func(c *Config, s string) (e error) {
+			c.UDPTimeout, e = time.ParseDuration(s)
+			return
+		},
+	},
+	{
+		"EXPECTED_PATH_MTU", "0", func(c *Config, s string) (e error) {
+			c.ExpectedPathMTU, e = strconv.Atoi(s)
+			return
+		},
+	},
+	{
+		"MAX_CLOCK_OFFSET", "100ms", func(c *Config, s string) (e error) {
+			c.MaxClockOffset, e = time.ParseDuration(s)
+			return
+		},
+	},
+	{
+		// parts per million, so 500 is half a millisecond gained or lost
+		// every second.  0 turns the alert off.
+		"MAX_CLOCK_DRIFT_PPM", "500", func(c *Config, s string) (e error) {
+			ppm, e := strconv.ParseFloat(s, 64)
+			if e == nil && ppm < 0 {
+				e = fmt.Errorf("must not be negative")
+			}
+			c.MaxClockDrift = ppm / 1e6
+			return
+		},
+	},
+	{
+		"IDLE_MIN_GAP", "15s", func(c *Config, s string) (e error) {
+			c.IdleMinGap, e = time.ParseDuration(s)
+			if e == nil && c.IdleMinGap <= 0 {
+				e = fmt.Errorf("gap must be positive")
+			}
+			return
+		},
+	},
+	{
+		"IDLE_MAX_GAP", "30m", func(c *Config, s string) (e error) {
+			c.IdleMaxGap, e = time.ParseDuration(s)
+			if e == nil && c.IdleMaxGap < c.IdleMinGap {
+				e = fmt.Errorf("must be at least IDLE_MIN_GAP")
+			}
+			return
+		},
+	},
+	{
+		"PROBE_TARGETS", "", func(c *Config, s string) (e error) {
+			c.ProbeTargets, e = science.ParseProbeTargets(s)
+			return
+		},
+	},
+	{
+		"PROBE_TIMEOUT", "5s", func(c *Config, s string) (e error) {
+			c.ProbeTimeout, e = time.ParseDuration(s)
+			return
+		},
+	},
+	{
+		"DNS_NAMES", "", func(c *Config, s string) (e error) {
+			c.DNSNames = splitList(s)
+			return
+		},
+	},
+	{
+		"DNS_RESOLVERS", science.ResolverSystem, func(c *Config, s string) (e error) {
+			c.DNSResolvers = splitList(s)
+			for _, r := range c.DNSResolvers {
+				if r != science.ResolverSystem && net.ParseIP(r) == nil {
+					if _, _, e = net.SplitHostPort(r); e != nil {
+						return fmt.Errorf("resolver %q is neither %q nor an address", r, science.ResolverSystem)
+					}
+				}
+			}
+			return
+		},
+	},
+	{
+		"DNS_TIMEOUT", "2s", func(c *Config, s string) (e error) {
+			c.DNSTimeout, e = time.ParseDuration(s)
+			return
+		},
+	},
+	{
+		"LOAD_RATE", "0", func(c *Config, s string) (e error) {
+			c.LoadRate, e = strconv.ParseFloat(s, 64)
+			if e == nil && c.LoadRate < 0 {
+				e = fmt.Errorf("rate must not be negative")
+			}
+			// the request ticker cannot tick faster than once a nanosecond,
+			// and nothing useful is measured long before that
+			if e == nil && c.LoadRate > 1e6 {
+				e = fmt.Errorf("rate must be at most 1000000 per second")
+			}
+			return
+		},
+	},
+	{
+		"LOAD_CONCURRENCY", "10", func(c *Config, s string) (e error) {
+			c.LoadConcurrency, e = strconv.Atoi(s)
+			if e == nil && c.LoadConcurrency < 1 {
+				e = fmt.Errorf("need at least one worker")
+			}
+			return
+		},
+	},
+	{
+		"LOAD_DURATION", "10s", func(c *Config, s string) (e error) {
+			c.LoadDuration, e = time.ParseDuration(s)
+			return
+		},
+	},
+	{
+		"LOAD_REQUEST_SIZE", "128", func(c *Config, s string) (e error) {
+			c.LoadRequestSize, e = strconv.Atoi(s)
+			return
+		},
+	},
+	{
+		"LOAD_RESPONSE_SIZE", "128", func(c *Config, s string) (e error) {
+			c.LoadResponseSize, e = strconv.Atoi(s)
+			if e == nil && int64(c.LoadResponseSize) > c.MaxPayloadSize {
+				e = fmt.Errorf("must be at most MAX_PAYLOAD_SIZE")
+			}
+			return
+		},
+	},
+	{
+		"HTTP2_PROBES", "false", func(c *Config, s string) (e error) {
+			c.HTTP2Probes, e = strconv.ParseBool(s)
+			return
+		},
+	},
+	{
+		// e.g. {"latency": {"dscp": 46}, "bandwidth": {"interface": "eth1"}}
+		"DIAL_OPTIONS", "", func(c *Config, s string) error {
+			if s == "" {
+				return nil
+			}
+			if err := json.Unmarshal([]byte(s), &c.DialOptions); err != nil {
+				return err
+			}
+			for experiment, opts := range c.DialOptions {
+				if !experimentNames[experiment] {
+					return fmt.Errorf("dial options for unknown experiment %q", experiment)
+				}
+				if !dialExperiments[experiment] {
+					return fmt.Errorf("dial options are not supported by the %s experiment", experiment)
+				}
+				// the TCP data plane and the idle experiment dial bare
+				// sockets, which would go out unmarked
+				if experiment == "bandwidth" && c.DataPlanePort != 0 {
+					return fmt.Errorf("dial options are not supported by the bandwidth experiment when DATA_PLANE_PORT is set")
+				}
+				if err := opts.Validate(); err != nil {
+					return fmt.Errorf("%s: %s", experiment, err)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		"RATE_LIMIT", "0", func(c *Config, s string) (e error) {
+			c.RateLimit, e = strconv.ParseFloat(s, 64)
+			if e == nil && c.RateLimit < 0 {
+				e = fmt.Errorf("must not be negative")
+			}
+			return
+		},
+	},
+	{
+		"RATE_LIMIT_BURST", "65536", func(c *Config, s string) (e error) {
+			c.RateLimitBurst, e = strconv.ParseInt(s, 10, 64)
+			if e == nil && c.RateLimitBurst < 1 {
+				e = fmt.Errorf("must be positive")
+			}
+			return
+		},
+	},
+	{
+		"BUDGET_BYTES_PER_HOUR", "0", func(c *Config, s string) (e error) {
+			c.BudgetBytesPerHour, e = strconv.ParseInt(s, 10, 64)
+			if e == nil && c.BudgetBytesPerHour < 0 {
+				e = fmt.Errorf("must not be negative")
+			}
+			return
+		},
+	},
+	{
+		// e.g. {"bandwidth": ["* 0-6 * * *"], "load": ["* 1-5 * * 1-5", "* * * * 0,6"]}
+		"SCHEDULE_WINDOWS", "", func(c *Config, s string) error {
+			if s == "" {
+				return nil
+			}
+			var specs map[string][]string
+			if err := json.Unmarshal([]byte(s), &specs); err != nil {
+				return err
+			}
+			c.ScheduleWindows = make(map[string][]*schedule.Window)
+			for experiment, windows := range specs {
+				if !experimentNames[experiment] {
+					return fmt.Errorf("windows for unknown experiment %q", experiment)
+				}
+				for _, spec := range windows {
+					w, err := schedule.ParseWindow(spec)
+					if err != nil {
+						return err
+					}
+					c.ScheduleWindows[experiment] = append(c.ScheduleWindows[experiment], w)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		"BANDWIDTH_LEASE_TTL", "1m", func(c *Config, s string) (e error) {
+			c.BandwidthLeaseTTL, e = time.ParseDuration(s)
+			return
+		},
+	},
+	{
+		"COVERAGE_PERIOD", "0", func(c *Config, s string) (e error) {
+			c.CoveragePeriod, e = time.ParseDuration(s)
+			return
+		},
+	},
+}
+
+// experimentNames are how experiments are known in config and in the admin
+// and status APIs
+var experimentNames = map[string]bool{
+	"bandwidth":    true,
+	"latency":      true,
+	"clock":        true,
+	"reachability": true,
+	"idle":         true,
+	"routing":      true,
+	"probe":        true,
+	"dns":          true,
+	"load":         true,
+	"udp":          true,
+	"mtu":          true,
+}
+
+// dialExperiments are the experiments whose traffic DIAL_OPTIONS can mark
+// or bind
+var dialExperiments = map[string]bool{
+	"bandwidth":    true,
+	"latency":      true,
+	"reachability": true,
+	"routing":      true,
+	"probe":        true,
+	"load":         true,
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var ret []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
 }
 
 func GetConfig(logger lager.Logger, environ []string) (*Config, error) {
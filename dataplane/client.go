@@ -0,0 +1,157 @@
+package dataplane
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/rosenhouse/reflex/science"
+)
+
+type Client struct {
+	Port        int
+	PayloadPath string
+	DialTimeout time.Duration
+}
+
+// dial opens a bandwidth test and waits for the server to accept it.  A
+// server busy with another peer's test answers science.ErrBusy.
+func (c *Client) dial(host string, h header) (*net.TCPConn, error) {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, c.Port), c.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tcpConn := conn.(*net.TCPConn)
+	if err := c.open(tcpConn, h); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return tcpConn, nil
+}
+
+// open sends the header and waits for the server to accept it
+func (c *Client) open(conn net.Conn, h header) error {
+	if err := h.write(conn); err != nil {
+		return err
+	}
+
+	status := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(c.DialTimeout))
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch status[0] {
+	case statusReady:
+		return nil
+	case statusBusy:
+		return science.ErrBusy
+	case statusRefused:
+		return errors.New("refused by server")
+	default:
+		return fmt.Errorf("unexpected status %q", status[0])
+	}
+}
+
+func (c *Client) TestBandwidth(logger lager.Logger, host string, spec science.BandwidthSpec) (*science.BandwidthExperimentResult, error) {
+	conn, err := c.dial(host, newHeader(directionUpload, spec))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	logger.Debug("starting-raw", lager.Data{"spec": spec})
+	if _, err := sendPayload(conn, c.PayloadPath, spec); err != nil {
+		return nil, err
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return nil, err
+	}
+
+	result := &science.BandwidthExperimentResult{}
+	if err := json.NewDecoder(conn).Decode(result); err != nil {
+		return nil, err
+	}
+	result.ClientTCPInfo = readTCPInfo(logger, conn)
+
+	logger.Debug("complete")
+	return result, nil
+}
+
+func (c *Client) TestDownload(logger lager.Logger, host string, spec science.BandwidthSpec) (*science.BandwidthExperimentResult, error) {
+	conn, err := c.dial(host, newHeader(directionDownload, spec))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	logger.Debug("starting-raw-download", lager.Data{"spec": spec})
+	result := &science.BandwidthExperimentResult{
+		Transport: science.TransportTCP,
+		Direction: science.DirectionDownload,
+	}
+
+	startTime := time.Now()
+	result.NumBytes, err = discardPayload(conn)
+	if err != nil {
+		return nil, err
+	}
+	result.DurationSeconds = time.Since(startTime).Seconds()
+	result.AvgBandwidth = float64(result.NumBytes) / result.DurationSeconds
+	result.ClientTCPInfo = readTCPInfo(logger, conn)
+
+	logger.Debug("complete")
+	return result, nil
+}
+
+// OpenIdle opens a connection to the peer's echo mode, with TCP keep-alives
+// off so that nothing but Ping crosses it
+func (c *Client) OpenIdle(logger lager.Logger, host string) (science.IdleConn, error) {
+	dialer := &net.Dialer{Timeout: c.DialTimeout, KeepAlive: -1}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(c.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.open(conn, header{Direction: modeEcho}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &echoConn{conn: conn}, nil
+}
+
+type echoConn struct {
+	conn net.Conn
+	seq  uint64
+}
+
+// Ping sends a sequence number and waits up to timeout for it to come back
+func (e *echoConn) Ping(timeout time.Duration) error {
+	e.seq++
+	e.conn.SetDeadline(time.Now().Add(timeout))
+	if err := binary.Write(e.conn, binary.BigEndian, e.seq); err != nil {
+		return err
+	}
+
+	var echoed uint64
+	if err := binary.Read(e.conn, binary.BigEndian, &echoed); err != nil {
+		return err
+	}
+	if echoed != e.seq {
+		return fmt.Errorf("echoed %d, expected %d", echoed, e.seq)
+	}
+	return nil
+}
+
+func (e *echoConn) Close() error {
+	return e.conn.Close()
+}
@@ -0,0 +1,136 @@
+// Package dataplane is a bare TCP alternative to the HTTP bandwidth test.
+// The sender pushes a pre-generated payload file with sendfile and the
+// receiver splices it into /dev/null, so neither side copies the payload
+// through user space and the results show what the HTTP stack costs.
+// Payloads are not verified on this path.
+package dataplane
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/rosenhouse/reflex/science"
+	"github.com/rosenhouse/reflex/tcpinfo"
+)
+
+const (
+	directionUpload   byte = 'U'
+	directionDownload byte = 'D'
+
+	// modeEcho holds the connection open and echoes whatever arrives, for
+	// finding idle timeouts along the path
+	modeEcho byte = 'E'
+)
+
+// For upload and download the server answers the header with one of these
+// before any payload moves
+const (
+	statusReady   byte = 'R'
+	statusBusy    byte = 'B'
+	statusRefused byte = 'X'
+)
+
+// header opens every connection, sent by the client.  When Duration is set
+// the sender streams until it has passed and NumBytes is ignored.
+type header struct {
+	Direction byte
+	NumBytes  int64
+	Duration  int64
+}
+
+func newHeader(direction byte, spec science.BandwidthSpec) header {
+	return header{Direction: direction, NumBytes: spec.PayloadSize, Duration: int64(spec.Duration)}
+}
+
+func (h header) spec() science.BandwidthSpec {
+	return science.BandwidthSpec{PayloadSize: h.NumBytes, Duration: time.Duration(h.Duration)}
+}
+
+func (h header) write(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, h)
+}
+
+func readHeader(r io.Reader) (header, error) {
+	h := header{}
+	err := binary.Read(r, binary.BigEndian, &h)
+	return h, err
+}
+
+// PayloadFileSize is kept small since app containers have little disk
+const PayloadFileSize = 4 << 20
+
+// WritePayloadFile fills path with PayloadFileSize bytes of seeded payload
+func WritePayloadFile(path string, seed uint64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, io.LimitReader(science.NewPayload(seed, science.PayloadRandom), PayloadFileSize))
+	return err
+}
+
+// sendPayload writes the payload file to conn over and over until spec is
+// satisfied.  Each pass is a LimitedReader around the file, which the
+// runtime turns into sendfile.
+func sendPayload(conn *net.TCPConn, payloadPath string, spec science.BandwidthSpec) (int64, error) {
+	f, err := os.Open(payloadPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	deadline := time.Now().Add(spec.Duration)
+	var sent int64
+	for {
+		chunk := int64(PayloadFileSize)
+		if spec.Duration > 0 {
+			if time.Now().After(deadline) {
+				return sent, nil
+			}
+		} else {
+			if sent >= spec.PayloadSize {
+				return sent, nil
+			}
+			if remaining := spec.PayloadSize - sent; remaining < chunk {
+				chunk = remaining
+			}
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return sent, err
+		}
+		n, err := conn.ReadFrom(&io.LimitedReader{R: f, N: chunk})
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+}
+
+func readTCPInfo(logger lager.Logger, conn net.Conn) *tcpinfo.Stats {
+	stats, err := tcpinfo.Read(conn)
+	if err != nil {
+		logger.Debug("tcp-info-unavailable", lager.Data{"error": err.Error()})
+		return nil
+	}
+	return stats
+}
+
+// discardPayload reads r to EOF into /dev/null.  The runtime splices when
+// r is a TCP connection, or a LimitedReader around one.
+func discardPayload(r io.Reader) (int64, error) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer devNull.Close()
+
+	return devNull.ReadFrom(r)
+}
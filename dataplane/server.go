@@ -0,0 +1,206 @@
+package dataplane
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/rosenhouse/reflex/science"
+)
+
+const (
+	// headerTimeout bounds how long a connection may sit before saying
+	// what it wants
+	headerTimeout = 10 * time.Second
+
+	// durationGrace is how long past its duration a test may run
+	durationGrace = 5 * time.Second
+
+	// maxEchoConns bounds the echo connections held at once.  Peers hold
+	// one each, see IdleTimeoutExperiment.
+	maxEchoConns = 256
+
+	// maxEchoBytes is far more than the pings of one idle ladder
+	maxEchoBytes = 1 << 20
+)
+
+// Server answers bandwidth tests and echo connections from sources inside
+// AllowedCIDR.  Bandwidth tests go through Admission like their HTTP
+// counterparts.  Echo connections are held for idle timeout tests, which
+// would shut out every other peer's bandwidth tests if they were admitted
+// the same way, so instead each source gets one at a time, up to
+// maxEchoConns in all, and none outlives EchoLifetime.
+type Server struct {
+	Logger       lager.Logger
+	Address      string
+	PayloadPath  string
+	Admission    science.Admission
+	Limits       science.BandwidthLimits
+	AllowedCIDR  *net.IPNet
+	EchoLifetime time.Duration
+
+	ReportAvgBandwidth func(float64)
+
+	echoLock sync.Mutex
+	echoing  map[string]bool
+}
+
+func (s *Server) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	listener, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+
+	acceptErrs := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				acceptErrs <- err
+				return
+			}
+			go s.handle(conn.(*net.TCPConn))
+		}
+	}()
+
+	close(ready)
+
+	select {
+	case <-signals:
+		listener.Close()
+		return nil
+	case err := <-acceptErrs:
+		return err
+	}
+}
+
+func (s *Server) handle(conn *net.TCPConn) {
+	defer conn.Close()
+
+	logger := s.Logger.Session("dataplane").WithData(lager.Data{"remote-addr": conn.RemoteAddr().String()})
+	defer logger.Debug("done")
+
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	h, err := readHeader(conn)
+	if err != nil {
+		logger.Error("read-header", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	holder := conn.RemoteAddr().(*net.TCPAddr).IP
+	if !s.AllowedCIDR.Contains(holder) {
+		logger.Info("peer-not-allowed")
+		conn.Write([]byte{statusRefused})
+		return
+	}
+
+	switch h.Direction {
+	case directionUpload, directionDownload:
+		if err := s.Limits.Check(h.spec()); err != nil {
+			logger.Info("bad-spec", lager.Data{"error": err.Error()})
+			conn.Write([]byte{statusRefused})
+			return
+		}
+		if !s.Admission.Enter(holder.String()) {
+			logger.Info("busy")
+			conn.Write([]byte{statusBusy})
+			return
+		}
+		defer s.Admission.Exit(holder.String())
+		if h.Duration > 0 {
+			conn.SetDeadline(time.Now().Add(time.Duration(h.Duration) + durationGrace))
+		}
+
+	case modeEcho:
+		if !s.enterEcho(holder.String()) {
+			logger.Info("echo-busy")
+			conn.Write([]byte{statusBusy})
+			return
+		}
+		defer s.exitEcho(holder.String())
+		conn.SetDeadline(time.Now().Add(s.EchoLifetime))
+
+	default:
+		logger.Info("unknown-direction", lager.Data{"direction": string(h.Direction)})
+		conn.Write([]byte{statusRefused})
+		return
+	}
+
+	if _, err := conn.Write([]byte{statusReady}); err != nil {
+		logger.Error("write-status", err)
+		return
+	}
+
+	switch h.Direction {
+	case directionUpload:
+		startTime := time.Now()
+		result := science.BandwidthExperimentResult{
+			Transport: science.TransportTCP,
+			Direction: science.DirectionUpload,
+		}
+		var payload io.Reader = conn
+		if h.Duration == 0 {
+			payload = io.LimitReader(conn, h.NumBytes)
+		}
+		result.NumBytes, err = discardPayload(payload)
+		if err != nil {
+			logger.Error("discard-payload", err)
+			return
+		}
+		result.DurationSeconds = time.Since(startTime).Seconds()
+		result.AvgBandwidth = float64(result.NumBytes) / result.DurationSeconds
+		result.ServerTCPInfo = readTCPInfo(logger, conn)
+
+		logger.Info("stats", lager.Data{"result": result})
+		s.ReportAvgBandwidth(result.AvgBandwidth)
+
+		if err := json.NewEncoder(conn).Encode(result); err != nil {
+			logger.Error("write-result", err)
+		}
+
+	case directionDownload:
+		sent, err := sendPayload(conn, s.PayloadPath, h.spec())
+		if err != nil {
+			logger.Error("send-payload", err, lager.Data{"sent": sent})
+			return
+		}
+		logger.Debug("sent", lager.Data{"bytes": sent, "tcp-info": readTCPInfo(logger, conn)})
+
+	case modeEcho:
+		// keep-alives would hide the very timeouts the client is looking for
+		conn.SetKeepAlive(false)
+		n, err := io.Copy(conn, io.LimitReader(conn, maxEchoBytes))
+		if err != nil {
+			logger.Info("echo-ended", lager.Data{"bytes": n, "error": err.Error()})
+			return
+		}
+		logger.Debug("echo-closed", lager.Data{"bytes": n})
+	}
+}
+
+// enterEcho admits one echo connection per source, up to maxEchoConns
+func (s *Server) enterEcho(source string) bool {
+	s.echoLock.Lock()
+	defer s.echoLock.Unlock()
+
+	if s.echoing == nil {
+		s.echoing = make(map[string]bool)
+	}
+	if s.echoing[source] || len(s.echoing) >= maxEchoConns {
+		return false
+	}
+	s.echoing[source] = true
+	return true
+}
+
+func (s *Server) exitEcho(source string) {
+	s.echoLock.Lock()
+	defer s.echoLock.Unlock()
+	delete(s.echoing, source)
+}
@@ -0,0 +1,186 @@
+// Package dnsquery sends single DNS questions straight to a resolver.  Go's
+// own resolver hides the response code and which server answered, and both
+// matter when DNS is the suspect.  Only A and AAAA answers are understood.
+package dnsquery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	TypeA    uint16 = 1
+	TypeAAAA uint16 = 28
+
+	classIN = 1
+)
+
+var rcodeNames = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+// RcodeName spells out a response code the way dig does
+func RcodeName(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+var (
+	errMalformed = errors.New("malformed dns response")
+	errMismatch  = errors.New("dns response does not answer the question asked")
+
+	// ErrTruncated means the answer did not fit in a datagram.  Retrying
+	// over TCP is left to real resolvers.
+	ErrTruncated = errors.New("dns response truncated")
+)
+
+const (
+	flagQR = 1 << 15
+	flagTC = 1 << 9
+)
+
+// Response is what came back for one question.  Answers holds the
+// addresses, sorted.
+type Response struct {
+	Rcode   int
+	Answers []string
+}
+
+// Exchange asks server, an address with an optional port, for records of
+// type qtype on name
+func Exchange(server, name string, qtype uint16, timeout time.Duration) (*Response, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	id := uint16(rand.Intn(1 << 16))
+	query, err := buildQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		// anything with the wrong id is stale or spoofed
+		if n >= 2 && binary.BigEndian.Uint16(buffer) == id {
+			return parseResponse(buffer[:n], query)
+		}
+	}
+}
+
+func buildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 1<<8) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)    // one question
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("bad name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(msg[len(msg)-4:], qtype)
+	binary.BigEndian.PutUint16(msg[len(msg)-2:], classIN)
+	return msg, nil
+}
+
+// parseResponse reads the answer to query, which must come back as a
+// response, whole, with the question it asked
+func parseResponse(msg, query []byte) (*Response, error) {
+	if len(msg) < 12 {
+		return nil, errMalformed
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&flagQR == 0 {
+		return nil, errMalformed
+	}
+	if flags&flagTC != 0 {
+		return nil, ErrTruncated
+	}
+	r := &Response{Rcode: int(flags & 0xf)}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	// resolvers may change the case of the name, but nothing else
+	question := query[12:]
+	if questions != 1 || len(msg) < 12+len(question) || !bytes.EqualFold(msg[12:12+len(question)], question) {
+		return nil, errMismatch
+	}
+	qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+
+	offset := 12 + len(question)
+	var err error
+
+	for i := 0; i < answers; i++ {
+		if offset, err = skipName(msg, offset); err != nil {
+			return nil, err
+		}
+		if offset+10 > len(msg) {
+			return nil, errMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[offset:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return nil, errMalformed
+		}
+
+		// CNAMEs and the like come along too, but only addresses are kept
+		rdata := msg[offset : offset+length]
+		if rtype == qtype && (rtype == TypeA && length == 4 || rtype == TypeAAAA && length == 16) {
+			r.Answers = append(r.Answers, net.IP(rdata).String())
+		}
+		offset += length
+	}
+
+	sort.Strings(r.Answers)
+	return r, nil
+}
+
+// skipName steps over a possibly compressed name starting at offset
+func skipName(msg []byte, offset int) (int, error) {
+	for {
+		if offset >= len(msg) {
+			return 0, errMalformed
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			return offset + 2, nil
+		default:
+			offset += 1 + length
+		}
+	}
+}
@@ -1,20 +1,29 @@
 package handler
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/rosenhouse/reflex/science"
+	"github.com/rosenhouse/reflex/server"
+	"github.com/rosenhouse/reflex/tcpinfo"
 
 	"code.cloudfoundry.org/lager"
 )
 
 type Bandwidth struct {
-	Logger lager.Logger
+	Logger    lager.Logger
+	Admission science.Admission
+	Limits    science.BandwidthLimits
+
+	// TrustedRouter is where X-Forwarded-For is believed from, see
+	// leaseHolder
+	TrustedRouter *net.IPNet
 
 	ReportAvgBandwidth func(float64)
 }
@@ -23,12 +32,55 @@ func (h *Bandwidth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logger := h.Logger.Session("handle-bandwidth")
 	defer logger.Debug("done")
 
-	hasher := sha256.New()
+	holder := leaseHolder(r, h.Admission, h.TrustedRouter)
+	if !h.Admission.Enter(holder) {
+		logger.Info("busy", lager.Data{"holder": holder})
+		writeBusy(w)
+		return
+	}
+	defer h.Admission.Exit(holder)
+
+	spec, err := science.ParseBandwidthSpec(r.URL.Query())
+	if err == nil {
+		err = h.Limits.Check(spec)
+	}
+	if err != nil {
+		logger.Info("bad-spec", lager.Data{"query": r.URL.RawQuery})
+		w.WriteHeader(http.StatusBadRequest)
+		encodeError(w, err.Error())
+		return
+	}
+
+	verifier := science.NewPayloadVerifier(spec.Seed, spec.Kind)
+	ramp := &science.RampRecorder{}
 	startTime := time.Now()
 
-	var err error
-	result := science.BandwidthExperimentResult{}
-	result.NumBytes, err = io.Copy(hasher, r.Body)
+	result := science.BandwidthExperimentResult{
+		Transport: science.TransportHTTP,
+		Protocol:  r.Proto,
+		Direction: science.DirectionUpload,
+		Kind:      spec.Kind,
+	}
+
+	wire := &science.CountingReader{Reader: limitUpload(w, r, spec)}
+	var body io.Reader = wire
+	if result.Encoding = r.Header.Get("Content-Encoding"); result.Encoding == science.EncodingGzip {
+		body, err = gzip.NewReader(wire)
+	}
+	if err == nil {
+		result.NumBytes, err = io.Copy(io.MultiWriter(verifier, ramp), body)
+	}
+	result.WireBytes = wire.N
+	if err == nil && spec.Duration == 0 && result.NumBytes > spec.PayloadSize {
+		err = &http.MaxBytesError{Limit: spec.PayloadSize}
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		logger.Info("upload-too-large", lager.Data{"limit": tooLarge.Limit})
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		encodeError(w, "upload larger than the test")
+		return
+	}
 	if err != nil {
 		logger.Error("read-request-body", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -37,11 +89,134 @@ func (h *Bandwidth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	result.DurationSeconds = time.Since(startTime).Seconds()
-	result.SHA256 = hex.EncodeToString(hasher.Sum(nil))
 	result.AvgBandwidth = float64(result.NumBytes) / result.DurationSeconds
+	result.RampUp = ramp.Points()
+	result.Integrity = verifier.Integrity
+	result.ServerTCPInfo = readTCPInfo(logger, r)
 
-	logger.Info("stats", lager.Data{"result": result})
-	h.ReportAvgBandwidth(result.AvgBandwidth)
+	if result.Corrupt {
+		logger.Error("payload-corrupt", nil, lager.Data{"result": result})
+	} else {
+		logger.Info("stats", lager.Data{"result": result})
+	}
+	// the plain bandwidth series is random payloads over HTTP/1.1 only, as
+	// on the client.  A stream on its own says little, the client reports
+	// the aggregate.
+	plain := (spec.Kind == "" || spec.Kind == science.PayloadRandom) && result.Encoding == "" && r.ProtoMajor == 1
+	if plain && spec.Streams <= 1 {
+		h.ReportAvgBandwidth(result.AvgBandwidth)
+	}
 
 	json.NewEncoder(w).Encode(result)
 }
+
+// uploadGrace is how long past its duration an upload may keep sending
+const uploadGrace = 5 * time.Second
+
+// limitUpload holds the request body to the test the client asked for: no
+// more than its bytes, allowing for gzip framing, or no longer than its
+// duration
+func limitUpload(w http.ResponseWriter, r *http.Request, spec science.BandwidthSpec) io.Reader {
+	if spec.Duration > 0 {
+		http.NewResponseController(w).SetReadDeadline(time.Now().Add(spec.Duration + uploadGrace))
+		return r.Body
+	}
+	limit := spec.PayloadSize
+	if r.Header.Get("Content-Encoding") == science.EncodingGzip {
+		// stored blocks add 5 bytes in every 64KiB, plus header and trailer
+		limit += limit/1024 + 1024
+	}
+	return http.MaxBytesReader(w, r.Body, limit)
+}
+
+type BandwidthSource struct {
+	Logger    lager.Logger
+	Admission science.Admission
+	Limits    science.BandwidthLimits
+
+	// TrustedRouter is where X-Forwarded-For is believed from, see
+	// leaseHolder
+	TrustedRouter *net.IPNet
+}
+
+func (h *BandwidthSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.Logger.Session("handle-bandwidth-source")
+	defer logger.Debug("done")
+
+	holder := leaseHolder(r, h.Admission, h.TrustedRouter)
+	if !h.Admission.Enter(holder) {
+		logger.Info("busy", lager.Data{"holder": holder})
+		writeBusy(w)
+		return
+	}
+	defer h.Admission.Exit(holder)
+
+	spec, err := science.ParseBandwidthSpec(r.URL.Query())
+	if err == nil {
+		err = h.Limits.Check(spec)
+	}
+	if err != nil {
+		logger.Info("bad-spec", lager.Data{"query": r.URL.RawQuery})
+		w.WriteHeader(http.StatusBadRequest)
+		encodeError(w, err.Error())
+		return
+	}
+
+	startTime := time.Now()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", science.ServerTCPInfoTrailer)
+
+	result := science.BandwidthExperimentResult{
+		Transport: science.TransportHTTP,
+		Direction: science.DirectionDownload,
+		Kind:      spec.Kind,
+		Encoding:  spec.Encoding,
+	}
+
+	wire := &science.CountingWriter{Writer: w}
+	payload := spec.Limit(science.NewPayload(spec.Seed, spec.Kind))
+	if spec.Encoding == science.EncodingGzip {
+		w.Header().Set("Content-Encoding", science.EncodingGzip)
+		gz, _ := gzip.NewWriterLevel(wire, gzip.BestSpeed)
+		result.NumBytes, err = io.Copy(gz, payload)
+		if err == nil {
+			err = gz.Close()
+		}
+	} else {
+		result.NumBytes, err = io.Copy(wire, payload)
+	}
+	result.WireBytes = wire.N
+	if err != nil {
+		logger.Error("write-response-body", err)
+		return
+	}
+
+	result.DurationSeconds = time.Since(startTime).Seconds()
+	result.AvgBandwidth = float64(result.NumBytes) / result.DurationSeconds
+
+	// flush so the statistics cover the whole body rather than what happens
+	// to have left the buffer
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	if result.ServerTCPInfo = readTCPInfo(logger, r); result.ServerTCPInfo != nil {
+		encoded, _ := json.Marshal(result.ServerTCPInfo)
+		w.Header().Set(science.ServerTCPInfoTrailer, string(encoded))
+	}
+
+	logger.Info("stats", lager.Data{"result": result})
+}
+
+func readTCPInfo(logger lager.Logger, r *http.Request) *tcpinfo.Stats {
+	conn := server.ConnFromContext(r.Context())
+	if conn == nil {
+		return nil
+	}
+
+	stats, err := tcpinfo.Read(conn)
+	if err != nil {
+		logger.Debug("tcp-info-unavailable", lager.Data{"error": err.Error()})
+		return nil
+	}
+	return stats
+}
@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/rosenhouse/reflex/science"
+)
+
+// Clock answers a timestamp exchange.  The receive time is taken as early
+// as the handler can, and the transmit time as late.
+type Clock struct {
+	Logger lager.Logger
+}
+
+func (h *Clock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stamps := science.ClockTimestamps{Receive: time.Now().UnixNano()}
+
+	logger := h.Logger.Session("handle-clock")
+	defer logger.Debug("done")
+
+	w.Header().Set("Content-Type", "application/json")
+	stamps.Transmit = time.Now().UnixNano()
+	if err := json.NewEncoder(w).Encode(stamps); err != nil {
+		logger.Error("encode", err)
+	}
+}
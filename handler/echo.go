@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Echo copies the request body back, or with ?size=N discards it and sends
+// N bytes instead, so that requests and responses can be sized separately.
+// N may be at most MaxSize.
+type Echo struct {
+	Logger  lager.Logger
+	MaxSize int64
+}
+
+func (h *Echo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.Logger.Session("handle-echo")
+	defer logger.Debug("done")
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		if _, err := io.Copy(w, r.Body); err != nil {
+			logger.Error("copy-body", err)
+		}
+		return
+	}
+
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		http.Error(w, "size must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+	if n > h.MaxSize {
+		http.Error(w, fmt.Sprintf("size must be at most %d", h.MaxSize), http.StatusBadRequest)
+		return
+	}
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		logger.Error("discard-body", err)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	if _, err := io.CopyN(w, zeros{}, n); err != nil {
+		logger.Error("write-body", err)
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/tedsuo/rata"
+
+	"github.com/rosenhouse/reflex/schedule"
+)
+
+// ExperimentControl pauses or resumes the experiment named in the path, or
+// every experiment when there is none, and replies with the new status.
+// Only sources inside AllowedCIDR may use it.
+type ExperimentControl struct {
+	Logger      lager.Logger
+	Controller  schedule.Controller
+	Pause       bool
+	AllowedCIDR *net.IPNet
+}
+
+func (h *ExperimentControl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.Logger.Session("handle-experiment-control")
+	defer logger.Debug("done")
+
+	if _, ok := allowSource(logger, w, r, h.AllowedCIDR); !ok {
+		return
+	}
+
+	name := rata.Param(r, "name")
+	var err error
+	switch {
+	case name == "" && h.Pause:
+		h.Controller.PauseAll()
+	case name == "":
+		h.Controller.ResumeAll()
+	case h.Pause:
+		err = h.Controller.Pause(name)
+	default:
+		err = h.Controller.Resume(name)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		encodeError(w, err.Error())
+		return
+	}
+	logger.Info("changed", lager.Data{"experiment": name, "paused": h.Pause})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Controller.Status())
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/rosenhouse/reflex/science"
+)
+
+// maxLeaseTTL bounds how long a peer that goes quiet can keep this node
+const maxLeaseTTL = 5 * time.Minute
+
+// BandwidthLease reserves this node for the bandwidth tests of the peer
+// that asks, for ?ttl= or a minute, and frees it again on DELETE.  Only
+// sources inside AllowedCIDR may hold a lease.  The reply carries a token
+// for the holder to send in science.LeaseHeader with its tests.
+type BandwidthLease struct {
+	Logger        lager.Logger
+	Admission     science.Admission
+	AllowedCIDR   *net.IPNet
+	TrustedRouter *net.IPNet
+}
+
+func (h *BandwidthLease) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.Logger.Session("handle-bandwidth-lease")
+	defer logger.Debug("done")
+
+	if _, ok := allowSource(logger, w, r, h.AllowedCIDR); !ok {
+		return
+	}
+
+	holder := leaseHolder(r, h.Admission, h.TrustedRouter)
+	if r.Method == "DELETE" {
+		h.Admission.Release(holder)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	ttl := time.Minute
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil || ttl <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			encodeError(w, "ttl must be a positive duration")
+			return
+		}
+	}
+	if ttl > maxLeaseTTL {
+		ttl = maxLeaseTTL
+	}
+
+	token, expires, ok := h.Admission.Lease(holder, ttl)
+	if !ok {
+		logger.Info("busy", lager.Data{"holder": holder})
+		writeBusy(w)
+		return
+	}
+	logger.Debug("leased", lager.Data{"holder": holder, "expires": expires})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Holder  string    `json:"holder"`
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}{holder, token, expires})
+}
+
+// leaseHolder names the peer behind a request by the lease token it
+// carries, so that a routed test is known as the peer that leased this
+// node even when no router is trusted, and by requestHolder otherwise
+func leaseHolder(r *http.Request, admission science.Admission, trustedRouter *net.IPNet) string {
+	if holder, ok := admission.Holder(r.Header.Get(science.LeaseHeader)); ok {
+		return holder
+	}
+	return requestHolder(r, trustedRouter)
+}
+
+// requestHolder names the peer behind a request.  Tests that come through
+// the platform router are known by the address it forwarded for, which is
+// the last one in X-Forwarded-For since anything before it came from the
+// client.  The header is ignored unless the request came from inside
+// trustedRouter.
+func requestHolder(r *http.Request, trustedRouter *net.IPNet) string {
+	ip, err := parseHostIP(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if trustedRouter == nil || !trustedRouter.Contains(ip) {
+		return ip.String()
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	return ip.String()
+}
+
+func writeBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "5")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	encodeError(w, science.ErrBusy.Error())
+}
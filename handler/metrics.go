@@ -45,6 +45,13 @@ const body = `
     <div class="container">
       <div id="roundTrips"></div>
       <div id="bandwidth"></div>
+      <h4>Bandwidth asymmetry (MB/s)</h4>
+      <table id="asymmetry" class="table table-condensed">
+        <thead>
+          <tr><th>Target</th><th>Mode</th><th>Upload</th><th>Download</th><th>Upload / Download</th></tr>
+        </thead>
+        <tbody></tbody>
+      </table>
     </div>
     <script type="text/javascript" src="//cdnjs.cloudflare.com/ajax/libs/jquery/3.1.0/jquery.slim.min.js"></script>
     <script type="text/javascript" src="//cdnjs.cloudflare.com/ajax/libs/d3/3.5.17/d3.min.js"></script>
@@ -95,6 +102,32 @@ const body = `
             .dimension(bwDim)
             .group(bwGrouped);
             chartBandwidth.render();
+
+          var mean = function(values) {
+            return d3.sum(values) / values.length / 1000000;
+          };
+          var pairs = {};
+          Object.keys(metrics).forEach(function(key) {
+            var m = key.match(/^(bandwidth(?:_bidirectional)?)\/(upload|download)\/(.+)$/);
+            if (!m) { return; }
+            var mode = m[1] === "bandwidth" ? "one-way" : "simultaneous";
+            var id = m[3] + " " + mode;
+            pairs[id] = pairs[id] || {target: m[3], mode: mode};
+            pairs[id][m[2]] = mean(metrics[key]);
+          });
+          var rows = d3.select("#asymmetry tbody").selectAll("tr")
+            .data(d3.values(pairs))
+            .enter().append("tr");
+          rows.selectAll("td")
+            .data(function(p) {
+              var ratio = (p.upload && p.download) ? (p.upload / p.download).toFixed(2) : "";
+              return [p.target, p.mode,
+                p.upload ? p.upload.toFixed(2) : "",
+                p.download ? p.download.toFixed(2) : "",
+                ratio];
+            })
+            .enter().append("td")
+            .text(function(d) { return d; });
         });
     </script>
   </body>
@@ -43,26 +43,36 @@ func (h *PeerPost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logger := h.Logger.Session("handle-post")
 	defer logger.Debug("done")
 
+	clientIP, ok := allowSource(logger, w, r, h.AllowedCIDR)
+	if !ok {
+		return
+	}
+
+	h.Peers.Upsert(logger, clientIP.String())
+
+	snapshot := h.Peers.Snapshot(logger)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// allowSource checks that r comes from inside cidr, and answers it with an
+// error when it does not
+func allowSource(logger lager.Logger, w http.ResponseWriter, r *http.Request, cidr *net.IPNet) (net.IP, bool) {
 	clientIP, err := parseHostIP(r.RemoteAddr) // http server sets r.RemoteAddr to "IP:port"
 	if err != nil {
 		logger.Error("parse-remote-addr", err, lager.Data{"remote-addr": r.RemoteAddr})
 		w.WriteHeader(http.StatusInternalServerError)
 		encodeError(w, "cannot parse remote address")
-		return
+		return nil, false
 	}
 
-	if !h.AllowedCIDR.Contains(clientIP) {
+	if !cidr.Contains(clientIP) {
 		logger.Info("peer-not-allowed", lager.Data{"remote-addr": r.RemoteAddr})
 		w.WriteHeader(http.StatusForbidden)
 		encodeError(w, "source ip not allowed")
-		return
+		return nil, false
 	}
-
-	h.Peers.Upsert(logger, clientIP.String())
-
-	snapshot := h.Peers.Snapshot(logger)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(snapshot)
+	return clientIP, true
 }
 
 func parseHostIP(addr string) (net.IP, error) {
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/tedsuo/rata"
+
+	"github.com/rosenhouse/reflex/job"
+	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/science"
+)
+
+// maxTriggerCount keeps one request from queueing up hours of tests
+const maxTriggerCount = 20
+
+type Triggerable interface {
+	Trigger(logger lager.Logger, spec science.TriggerSpec) (*science.TriggerResult, error)
+}
+
+// ExperimentTrigger runs the experiment named in the path now, ignoring its
+// schedule, against ?target= if given, with ?payload_size= and ?count=.
+// It waits for the result unless ?async=true, in which case it replies at
+// once with a job to poll at /jobs/:id.  The target must be a current peer,
+// the payload no bigger than MaxPayloadSize, and the source inside
+// AllowedCIDR.
+type ExperimentTrigger struct {
+	Logger         lager.Logger
+	Experiments    map[string]Triggerable
+	Jobs           job.Store
+	Peers          peer.List
+	MaxPayloadSize int64
+	AllowedCIDR    *net.IPNet
+}
+
+func (h *ExperimentTrigger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.Logger.Session("handle-experiment-trigger")
+	defer logger.Debug("done")
+
+	if _, ok := allowSource(logger, w, r, h.AllowedCIDR); !ok {
+		return
+	}
+
+	name := rata.Param(r, "name")
+	experiment, ok := h.Experiments[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		encodeError(w, "no such experiment can be triggered")
+		return
+	}
+
+	spec, async, err := parseTrigger(r, h.MaxPayloadSize)
+	if err == nil && spec.Target != "" && !h.isPeer(logger, spec.Target) {
+		err = fmt.Errorf("target %q is not a current peer", spec.Target)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		encodeError(w, err.Error())
+		return
+	}
+
+	logger.Info("triggered", lager.Data{"experiment": name, "spec": spec, "async": async})
+	id, done, err := h.Jobs.Start(name, spec, func() (interface{}, error) {
+		return experiment.Trigger(h.Logger, spec)
+	})
+	if err == job.ErrTooManyJobs {
+		w.WriteHeader(http.StatusTooManyRequests)
+		encodeError(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if async {
+		w.Header().Set("Location", "/jobs/"+id)
+		w.WriteHeader(http.StatusAccepted)
+		j, _ := h.Jobs.Get(id)
+		json.NewEncoder(w).Encode(j)
+		return
+	}
+
+	// a caller who gives up can still find the job
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		return
+	}
+	j, _ := h.Jobs.Get(id)
+	if j.State == job.StateFailed {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(j)
+}
+
+func (h *ExperimentTrigger) isPeer(logger lager.Logger, host string) bool {
+	for _, p := range h.Peers.Snapshot(logger) {
+		if p.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTrigger(r *http.Request, maxPayloadSize int64) (science.TriggerSpec, bool, error) {
+	q := r.URL.Query()
+	spec := science.TriggerSpec{Target: q.Get("target"), Count: 1}
+
+	var err error
+	if s := q.Get("payload_size"); s != "" {
+		if spec.PayloadSize, err = strconv.ParseInt(s, 10, 64); err != nil || spec.PayloadSize < 1 {
+			return spec, false, errors.New("payload_size must be a positive integer")
+		}
+		if spec.PayloadSize > maxPayloadSize {
+			return spec, false, fmt.Errorf("payload_size must be at most %d", maxPayloadSize)
+		}
+	}
+	if s := q.Get("count"); s != "" {
+		if spec.Count, err = strconv.Atoi(s); err != nil || spec.Count < 1 || spec.Count > maxTriggerCount {
+			return spec, false, fmt.Errorf("count must be between 1 and %d", maxTriggerCount)
+		}
+	}
+	async := false
+	if s := q.Get("async"); s != "" {
+		if async, err = strconv.ParseBool(s); err != nil {
+			return spec, false, errors.New("async must be true or false")
+		}
+	}
+	return spec, async, nil
+}
+
+// JobStatus returns the job named in the path
+type JobStatus struct {
+	Logger lager.Logger
+	Jobs   job.Store
+}
+
+func (h *JobStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.Logger.Session("handle-job-status")
+	defer logger.Debug("done")
+
+	j, ok := h.Jobs.Get(rata.Param(r, "id"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		encodeError(w, "no such job")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
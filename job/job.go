@@ -0,0 +1,126 @@
+// Package job keeps track of experiments run on demand, so that a caller
+// who would rather not wait can come back for the result.
+package job
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+const (
+	// retained is how many jobs are remembered, oldest finished job
+	// forgotten first
+	retained = 100
+
+	// maxRunning is how many jobs may run at once, which keeps it well
+	// below retained so that there is always a finished job to forget
+	maxRunning = 4
+)
+
+var ErrTooManyJobs = errors.New("too many jobs running")
+
+type Job struct {
+	ID         string      `json:"id"`
+	Experiment string      `json:"experiment"`
+	Spec       interface{} `json:"spec"`
+	State      string      `json:"state"`
+	Started    time.Time   `json:"started"`
+	Finished   *time.Time  `json:"finished,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+type Store interface {
+	// Start calls run in the background and returns the new job's ID,
+	// along with a channel that is closed when it finishes.  It returns
+	// ErrTooManyJobs instead when too many are already running.
+	Start(experiment string, spec interface{}, run func() (interface{}, error)) (string, <-chan struct{}, error)
+	Get(id string) (Job, bool)
+}
+
+func NewStore() Store {
+	return &store{
+		lock: &sync.Mutex{},
+		jobs: make(map[string]*Job),
+	}
+}
+
+type store struct {
+	lock    *sync.Mutex
+	jobs    map[string]*Job
+	order   []string
+	running int
+}
+
+func (s *store) Start(experiment string, spec interface{}, run func() (interface{}, error)) (string, <-chan struct{}, error) {
+	j := &Job{
+		ID:         fmt.Sprintf("%016x", rand.Uint64()),
+		Experiment: experiment,
+		Spec:       spec,
+		State:      StateRunning,
+		Started:    time.Now(),
+	}
+
+	s.lock.Lock()
+	if s.running >= maxRunning {
+		s.lock.Unlock()
+		return "", nil, ErrTooManyJobs
+	}
+	s.running++
+	s.jobs[j.ID] = j
+	s.order = append(s.order, j.ID)
+	if len(s.order) > retained {
+		s.forget()
+	}
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, err := run()
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.running--
+		finished := time.Now()
+		j.Finished = &finished
+		j.Result = result
+		j.State = StateDone
+		if err != nil {
+			j.State = StateFailed
+			j.Error = err.Error()
+		}
+	}()
+	return j.ID, done, nil
+}
+
+// forget drops the oldest finished job, so that a running job can always
+// be polled.  Callers hold the lock.
+func (s *store) forget() {
+	for i, id := range s.order {
+		if s.jobs[id].State != StateRunning {
+			delete(s.jobs, id)
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *store) Get(id string) (Job, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
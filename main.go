@@ -4,18 +4,25 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
+	"github.com/rosenhouse/reflex/alert"
+	"github.com/rosenhouse/reflex/budget"
 	"github.com/rosenhouse/reflex/client"
+	"github.com/rosenhouse/reflex/dataplane"
 	"github.com/rosenhouse/reflex/handler"
+	"github.com/rosenhouse/reflex/job"
 	"github.com/rosenhouse/reflex/metric"
 	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
 	"github.com/rosenhouse/reflex/science"
+	"github.com/rosenhouse/reflex/server"
+	"github.com/rosenhouse/reflex/udpecho"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/grouper"
-	"github.com/tedsuo/ifrit/http_server"
 	"github.com/tedsuo/ifrit/sigmon"
 	"github.com/tedsuo/rata"
 
@@ -37,6 +44,42 @@ func parseLogLevel(level string) lager.LogLevel {
 	return lager.DEBUG
 }
 
+// dialSuffix tags the metrics of an experiment that has DIAL_OPTIONS, the
+// same way protocolSuffix tags HTTP/2
+func dialSuffix(opts client.DialOptions) string {
+	if tag := opts.Tag(); tag != "" {
+		return "_" + tag
+	}
+	return ""
+}
+
+// bandwidthMetricName keeps plain random uploads and downloads over HTTP
+// under "bandwidth", and adds a suffix for each way a test differs from that
+func bandwidthMetricName(r *science.BandwidthExperimentResult) string {
+	name := "bandwidth"
+	if r.Transport == science.TransportTCP {
+		name += "_tcp"
+	}
+	if r.Bidirectional {
+		name += "_bidirectional"
+	}
+	if r.Kind != "" && r.Kind != science.PayloadRandom {
+		name += "_" + r.Kind
+	}
+	if r.Encoding != "" {
+		name += "_" + r.Encoding
+	}
+	return name + protocolSuffix(r.Protocol)
+}
+
+// protocolSuffix leaves HTTP/1.1 metrics with the names they have always had
+func protocolSuffix(protocol string) string {
+	if protocol == science.ProtocolHTTP2 {
+		return "_http2"
+	}
+	return ""
+}
+
 func main() {
 	logger := lager.NewLogger("reflex")
 	sink := lager.NewReconfigurableSink(lager.NewWriterSink(os.Stdout, lager.DEBUG), lager.DEBUG)
@@ -55,16 +98,85 @@ func main() {
 	logger.Info("local-ip", lager.Data{"ip": myIP})
 
 	metricStore := metric.NewStore(config.MetricMaxCapacity)
+	alerts := alert.NewBoard()
+
+	reportRoundTripLatency := func(d time.Duration) {
+		metricStore.Report("round_trip", d.Seconds())
+	}
+	reportTiming := func(suffix string) func(string, client.Timing) {
+		return func(target string, t client.Timing) {
+			if t.DNSLookup > 0 {
+				metricStore.Report(metric.Key("phase_dns_lookup"+suffix, target), t.DNSLookup.Seconds())
+			}
+			if t.TCPConnect > 0 {
+				metricStore.Report(metric.Key("phase_tcp_connect"+suffix, target), t.TCPConnect.Seconds())
+			}
+			if t.TLSHandshake > 0 {
+				metricStore.Report(metric.Key("phase_tls_handshake"+suffix, target), t.TLSHandshake.Seconds())
+			}
+			metricStore.Report(metric.Key("phase_time_to_first_byte"+suffix, target), t.TimeToFirstByte.Seconds())
+			metricStore.Report(metric.Key("phase_transfer"+suffix, target), t.Transfer.Seconds())
+		}
+	}
 
-	client := &client.Client{
-		HTTPClient: http.DefaultClient,
-		Port:       config.Port,
+	limiter := budget.NewBucket(config.RateLimit, config.RateLimitBurst)
+	trafficBudget := budget.NewBudget(config.BudgetBytesPerHour, func(u budget.Usage) {
+		metricStore.Report("budget_used", float64(u.Used))
+		if u.BytesPerHour > 0 {
+			metricStore.Report("budget_remaining", float64(u.Remaining))
+		}
+		for experiment, n := range u.ByExperiment {
+			metricStore.Report(metric.Key("budget_used", experiment), float64(n))
+		}
+		for experiment, n := range u.Denied {
+			metricStore.Report(metric.Key("budget_denied", experiment), float64(n))
+		}
+	})
 
-		ReportRoundTripLatency: func(d time.Duration) {
-			metricStore.Report("round_trip", d.Seconds())
-		},
+	scheduler := schedule.NewController(myIP, config.ScheduleWindows)
+
+	newClient := func(protocol string, opts client.DialOptions) *client.Client {
+		newTransport := client.NewTransport
+		if protocol == science.ProtocolHTTP2 {
+			newTransport = client.NewH2CTransport
+		}
+		loadTransport := newTransport(true, opts)
+		loadTransport.MaxIdleConnsPerHost = config.LoadConcurrency
+
+		return &client.Client{
+			HTTPClient:      &http.Client{Transport: newTransport(true, opts)},
+			FreshHTTPClient: &http.Client{Transport: newTransport(false, opts)},
+			LoadHTTPClient:  &http.Client{Transport: loadTransport},
+			Port:            config.Port,
+			Dial:            opts,
+
+			ReportRoundTripLatency: reportRoundTripLatency,
+			ReportTiming:           reportTiming(protocolSuffix(protocol) + dialSuffix(opts)),
+		}
+	}
+
+	defaultClient := newClient(science.ProtocolHTTP1, client.DialOptions{})
+	var defaultHTTP2Client *client.Client
+	if config.HTTP2Probes {
+		defaultHTTP2Client = newClient(science.ProtocolHTTP2, client.DialOptions{})
+	}
+
+	// experiments with their own DIAL_OPTIONS get their own clients, so that
+	// marked traffic never shares a connection with unmarked
+	experimentClients := func(experiment string) (*client.Client, *client.Client) {
+		opts, ok := config.DialOptions[experiment]
+		if !ok {
+			return defaultClient, defaultHTTP2Client
+		}
+		var http2Client *client.Client
+		if config.HTTP2Probes {
+			http2Client = newClient(science.ProtocolHTTP2, opts)
+		}
+		return newClient(science.ProtocolHTTP1, opts), http2Client
 	}
 
+	client := defaultClient
+
 	peers := peer.NewList(config.TTL, myIP)
 
 	heartbeat := peer.Heartbeat{
@@ -98,18 +210,469 @@ func main() {
 		metricStore.Report("bandwidth", b)
 	}
 
+	// this node serves one peer's bandwidth tests at a time, and no bigger
+	// or longer than its own tests may be
+	admission := science.NewAdmission()
+	bandwidthLimits := science.BandwidthLimits{
+		MaxPayloadSize: config.MaxPayloadSize,
+		MaxDuration:    config.MaxBandwidthDuration,
+	}
+
 	bandwidthHandler := &handler.Bandwidth{
 		Logger:             logger,
+		Admission:          admission,
+		Limits:             bandwidthLimits,
+		TrustedRouter:      config.RouterCIDR,
 		ReportAvgBandwidth: reportAvgBandwidth,
 	}
 
+	bandwidthLeaseHandler := &handler.BandwidthLease{
+		Logger:        logger,
+		Admission:     admission,
+		AllowedCIDR:   config.AllowedPeers,
+		TrustedRouter: config.RouterCIDR,
+	}
+
+	bandwidthClient, bandwidthHTTP2Client := experimentClients("bandwidth")
+	bandwidthSuffix := dialSuffix(config.DialOptions["bandwidth"])
 	bandwidthExperiment := &science.BandwidthExperiment{
-		Peers:              peers,
-		Logger:             logger,
-		CheckInterval:      config.TTL,
-		Client:             client,
-		PayloadSize:        1 << 20, // ~ 1MB
-		ReportAvgBandwidth: reportAvgBandwidth,
+		Peers:         peers,
+		Logger:        logger,
+		CheckInterval: config.TTL,
+		Gate:          scheduler.Gate("bandwidth"),
+		Client:        bandwidthClient,
+		Alerts:        alerts,
+		Budget:        trafficBudget,
+		Limiter:       limiter,
+		Direction:     config.BandwidthDirection,
+		Streams:       config.BandwidthStreams,
+
+		Sizing:         config.BandwidthSizing,
+		PayloadSize:    config.PayloadSize,
+		MaxPayloadSize: config.MaxPayloadSize,
+		Duration:       config.BandwidthDuration,
+
+		PayloadKinds: config.PayloadKinds,
+		Encoding:     config.PayloadEncoding,
+
+		CoveragePeriod: config.CoveragePeriod,
+
+		ReportCoverage: func(overdue int, oldestSeconds float64) {
+			metricStore.Report("bandwidth_coverage_overdue", float64(overdue))
+			metricStore.Report("bandwidth_coverage_oldest", oldestSeconds)
+		},
+		ReportResult: func(target string, r *science.BandwidthExperimentResult) {
+			name := bandwidthMetricName(r)
+			if name == "bandwidth" || name == "bandwidth_bidirectional" {
+				reportAvgBandwidth(r.AvgBandwidth)
+			}
+			name += bandwidthSuffix
+			metricStore.Report(metric.Key(name, r.Direction, target), r.AvgBandwidth)
+			if r.Transport == science.TransportHTTP {
+				metricStore.Report(metric.Key(name+"_corrupt_blocks", r.Direction, target), float64(r.CorruptBlocks))
+			}
+
+			if tcp := r.SenderTCPInfo(); tcp != nil {
+				metricStore.Report(metric.Key(name+"_tcp_rtt", r.Direction, target), tcp.RTT)
+				metricStore.Report(metric.Key(name+"_tcp_rtt_var", r.Direction, target), tcp.RTTVar)
+				metricStore.Report(metric.Key(name+"_tcp_retransmits", r.Direction, target), float64(tcp.TotalRetransmits))
+				metricStore.Report(metric.Key(name+"_tcp_cwnd", r.Direction, target), float64(tcp.CongestionWindow))
+				metricStore.Report(metric.Key(name+"_tcp_pacing_rate", r.Direction, target), float64(tcp.PacingRate))
+				metricStore.Report(metric.Key(name+"_tcp_delivery_rate", r.Direction, target), float64(tcp.DeliveryRate))
+			}
+
+			if r.Streams != nil {
+				metricStore.Report(metric.Key(name+"_stream_mean", r.Direction, target), r.Streams.Mean)
+				metricStore.Report(metric.Key(name+"_stream_variance", r.Direction, target), r.Streams.Variance)
+				metricStore.Report(metric.Key(name+"_stream_fairness", r.Direction, target), r.Streams.Fairness)
+			}
+		},
+	}
+
+	if bandwidthHTTP2Client != nil {
+		bandwidthExperiment.HTTP2Client = bandwidthHTTP2Client
+	}
+	if config.BandwidthLeaseTTL > 0 {
+		bandwidthExperiment.Lessor = bandwidthClient
+		bandwidthExperiment.LeaseTTL = config.BandwidthLeaseTTL
+	}
+
+	var dataPlaneServer *dataplane.Server
+	var idleExperiment *science.IdleTimeoutExperiment
+	if config.DataPlanePort != 0 {
+		payloadPath := filepath.Join(os.TempDir(), "reflex-payload")
+		if err := dataplane.WritePayloadFile(payloadPath, uint64(time.Now().UnixNano())); err != nil {
+			logger.Fatal("write-payload-file", err)
+		}
+
+		// echo connections live long enough for a whole ladder of idle
+		// gaps, which double up to IdleMaxGap
+		dataPlaneServer = &dataplane.Server{
+			Logger:             logger,
+			Address:            fmt.Sprintf("%s:%d", "0.0.0.0", config.DataPlanePort),
+			PayloadPath:        payloadPath,
+			Admission:          admission,
+			Limits:             bandwidthLimits,
+			AllowedCIDR:        config.AllowedPeers,
+			EchoLifetime:       3 * config.IdleMaxGap,
+			ReportAvgBandwidth: func(b float64) { metricStore.Report("bandwidth_tcp", b) },
+		}
+		rawClient := &dataplane.Client{
+			Port:        config.DataPlanePort,
+			PayloadPath: payloadPath,
+			DialTimeout: config.TTL,
+		}
+		bandwidthExperiment.RawClient = rawClient
+
+		idleExperiment = &science.IdleTimeoutExperiment{
+			Peers:         peers,
+			Logger:        logger,
+			CheckInterval: config.TTL,
+			Gate:          scheduler.Gate("idle"),
+			Client:        rawClient,
+			MinGap:        config.IdleMinGap,
+			MaxGap:        config.IdleMaxGap,
+			PingTimeout:   config.TTL,
+
+			ReportResult: func(target string, r *science.IdleResult) {
+				metricStore.Report(metric.Key("idle_longest_working", target), r.LongestIdle)
+				if r.Failure != "" {
+					metricStore.Report(metric.Key("idle_failed_at", r.Failure, target), r.FailedIdle)
+				}
+			},
+		}
+	}
+
+	var udpServer *udpecho.Server
+	var udpExperiment *science.UDPExperiment
+	var mtuExperiment *science.MTUExperiment
+	if config.UDPPort != 0 {
+		udpServer = &udpecho.Server{
+			Logger:      logger,
+			Address:     fmt.Sprintf("%s:%d", "0.0.0.0", config.UDPPort),
+			AllowedCIDR: config.AllowedPeers,
+		}
+		udpClient := &udpecho.Client{
+			Port:       config.UDPPort,
+			Count:      config.UDPTrainLength,
+			Interval:   config.UDPTrainInterval,
+			PacketSize: config.UDPPacketSize,
+			Timeout:    config.UDPTimeout,
+		}
+		udpExperiment = &science.UDPExperiment{
+			Peers:         peers,
+			Logger:        logger,
+			CheckInterval: config.TTL,
+			Gate:          scheduler.Gate("udp"),
+			Client:        udpClient,
+
+			ReportResult: func(target string, r *science.UDPTrainResult) {
+				metricStore.Report(metric.Key("udp_loss", target), r.Loss)
+				metricStore.Report(metric.Key("udp_rtt_median", target), r.RTT.Median)
+				metricStore.Report(metric.Key("udp_reordered", "reverse", target), float64(r.ReverseReordered))
+				metricStore.Report(metric.Key("udp_duplicates", "reverse", target), float64(r.ReverseDuplicates))
+				metricStore.Report(metric.Key("udp_jitter", "reverse", target), r.ReverseJitter)
+				if r.ServerReported {
+					metricStore.Report(metric.Key("udp_loss", "forward", target), r.ForwardLoss)
+					metricStore.Report(metric.Key("udp_loss", "reverse", target), r.ReverseLoss)
+					metricStore.Report(metric.Key("udp_reordered", "forward", target), float64(r.ForwardReordered))
+					metricStore.Report(metric.Key("udp_duplicates", "forward", target), float64(r.ForwardDuplicates))
+					metricStore.Report(metric.Key("udp_jitter", "forward", target), r.ForwardJitter)
+				}
+			},
+		}
+		mtuExperiment = &science.MTUExperiment{
+			Peers:         peers,
+			Logger:        logger,
+			CheckInterval: config.TTL,
+			Gate:          scheduler.Gate("mtu"),
+			Client:        udpClient,
+			Alerts:        alerts,
+			ExpectedMTU:   config.ExpectedPathMTU,
+
+			ReportResult: func(target string, r *science.MTUResult) {
+				mismatch := 0.0
+				if r.Mismatch {
+					mismatch = 1
+				}
+				metricStore.Report(metric.Key("path_mtu", target), float64(r.PathMTU))
+				metricStore.Report(metric.Key("path_mtu_mismatch", target), mismatch)
+			},
+		}
+	}
+
+	bandwidthSourceHandler := &handler.BandwidthSource{
+		Logger:        logger,
+		Admission:     admission,
+		Limits:        bandwidthLimits,
+		TrustedRouter: config.RouterCIDR,
+	}
+
+	idleLatestHandler := &handler.MetricsData{
+		Logger: logger,
+		SnapshotGetter: func() interface{} {
+			if idleExperiment == nil {
+				return nil
+			}
+			return idleExperiment.Latest()
+		},
+	}
+
+	alertsHandler := &handler.MetricsData{
+		Logger:         logger,
+		SnapshotGetter: func() interface{} { return alerts.Snapshot() },
+	}
+
+	bandwidthLatestHandler := &handler.MetricsData{
+		Logger:         logger,
+		SnapshotGetter: func() interface{} { return bandwidthExperiment.Latest() },
+	}
+
+	latencyClient, latencyHTTP2Client := experimentClients("latency")
+	latencySuffix := dialSuffix(config.DialOptions["latency"])
+	latencyExperiment := &science.LatencyExperiment{
+		Peers:         peers,
+		Logger:        logger,
+		CheckInterval: config.TTL,
+		Gate:          scheduler.Gate("latency"),
+		Client:        latencyClient,
+		PingCount:     config.PingCount,
+
+		ReportLatency: func(target, protocol, connection string, s science.LatencySummary) {
+			name := "latency" + protocolSuffix(protocol) + latencySuffix
+			metricStore.Report(metric.Key(name+"_min", connection, target), s.Min)
+			metricStore.Report(metric.Key(name+"_median", connection, target), s.Median)
+			metricStore.Report(metric.Key(name+"_p95", connection, target), s.P95)
+			metricStore.Report(metric.Key(name+"_p99", connection, target), s.P99)
+			metricStore.Report(metric.Key(name+"_max", connection, target), s.Max)
+			metricStore.Report(metric.Key(name+"_jitter", connection, target), s.Jitter)
+		},
+	}
+
+	if latencyHTTP2Client != nil {
+		latencyExperiment.HTTP2Client = latencyHTTP2Client
+	}
+
+	reachabilityClient, _ := experimentClients("reachability")
+	reachabilitySuffix := dialSuffix(config.DialOptions["reachability"])
+	reachabilityExperiment := &science.ReachabilityExperiment{
+		Peers:         peers,
+		Logger:        logger,
+		CheckInterval: config.TTL,
+		Client:        reachabilityClient,
+		Alerts:        alerts,
+		Source:        myIP,
+		Timeout:       config.ConnectTimeout,
+		Workers:       config.ReachabilityWorkers,
+		Targets:       config.Reachability,
+		Policy:        config.ReachabilityPolicy,
+
+		ReportMatrix: func(m *science.ReachabilityMatrix) {
+			for _, c := range m.Cells {
+				reachable := 0.0
+				if c.Result == science.ReachAllowed {
+					reachable = 1
+				}
+				metricStore.Report(metric.Key("reachable"+reachabilitySuffix, strconv.Itoa(c.Port), c.Host), reachable)
+			}
+			metricStore.Report("reachability_policy_failures"+reachabilitySuffix, float64(m.Failures))
+		},
+	}
+
+	reachabilityHandler := &handler.MetricsData{
+		Logger:         logger,
+		SnapshotGetter: func() interface{} { return reachabilityExperiment.Latest() },
+	}
+
+	clockExperiment := &science.ClockExperiment{
+		Peers:         peers,
+		Logger:        logger,
+		CheckInterval: config.TTL,
+		Gate:          scheduler.Gate("clock"),
+		Client:        client,
+		Alerts:        alerts,
+		MaxOffset:     config.MaxClockOffset,
+		MaxDrift:      config.MaxClockDrift,
+
+		ReportEstimate: func(target string, e science.ClockEstimate) {
+			metricStore.Report(metric.Key("clock_offset", target), e.Offset)
+			metricStore.Report(metric.Key("clock_delay", target), e.Delay)
+			metricStore.Report(metric.Key("clock_drift", target), e.Drift)
+		},
+	}
+
+	clockHandler := &handler.Clock{
+		Logger: logger,
+	}
+
+	clockHistoryHandler := &handler.MetricsData{
+		Logger:         logger,
+		SnapshotGetter: func() interface{} { return clockExperiment.History() },
+	}
+
+	routingClient, _ := experimentClients("routing")
+	routingSuffix := dialSuffix(config.DialOptions["routing"])
+	routingExperiment := &science.RoutingExperiment{
+		Peers:         peers,
+		Logger:        logger,
+		CheckInterval: config.TTL,
+		Client:        routingClient,
+		Budget:        trafficBudget,
+		Limiter:       limiter,
+		Route:         config.Leader,
+		PingCount:     config.PingCount,
+		PayloadSize:   config.PayloadSize,
+
+		ReportResult: func(r *science.RoutingResult) {
+			metricStore.Report(metric.Key("routing_latency_median"+routingSuffix, "direct"), r.Direct.Median)
+			metricStore.Report(metric.Key("routing_latency_median"+routingSuffix, "routed"), r.Routed.Median)
+			metricStore.Report("routing_latency_overhead"+routingSuffix, r.Overhead)
+			metricStore.Report(metric.Key("routing_bandwidth"+routingSuffix, "direct"), r.DirectBandwidth)
+			metricStore.Report(metric.Key("routing_bandwidth"+routingSuffix, "routed"), r.RoutedBandwidth)
+			metricStore.Report("routing_bandwidth_ratio"+routingSuffix, r.BandwidthRatio)
+		},
+	}
+	if config.BandwidthLeaseTTL > 0 {
+		routingExperiment.Lessor = routingClient
+		routingExperiment.LeaseTTL = config.BandwidthLeaseTTL
+	}
+
+	probeClient, _ := experimentClients("probe")
+	probeSuffix := dialSuffix(config.DialOptions["probe"])
+	probeExperiment := &science.ProbeExperiment{
+		Logger:        logger,
+		CheckInterval: config.TTL,
+		Client:        probeClient,
+		Targets:       config.ProbeTargets,
+		Timeout:       config.ProbeTimeout,
+
+		ReportResult: func(r *science.ProbeResult) {
+			success := 0.0
+			if r.Success {
+				success = 1
+			}
+			metricStore.Report(metric.Key("probe_success"+probeSuffix, r.Kind, r.Name), success)
+			metricStore.Report(metric.Key("probe_duration"+probeSuffix, r.Kind, r.Name), r.Duration)
+			if r.Status != 0 {
+				metricStore.Report(metric.Key("probe_http_status"+probeSuffix, r.Name), float64(r.Status))
+			}
+		},
+	}
+
+	probesLatestHandler := &handler.MetricsData{
+		Logger:         logger,
+		SnapshotGetter: func() interface{} { return probeExperiment.Latest() },
+	}
+
+	dnsExperiment := &science.DNSExperiment{
+		Peers:         peers,
+		Logger:        logger,
+		CheckInterval: config.TTL,
+		Client:        client,
+		Source:        myIP,
+		Names:         config.DNSNames,
+		Resolvers:     config.DNSResolvers,
+		Timeout:       config.DNSTimeout,
+
+		ReportResult: func(r *science.DNSResult) {
+			success := 0.0
+			if r.Error == "" {
+				success = 1
+			}
+			metricStore.Report(metric.Key("dns_latency", r.Resolver, r.Name), r.Latency)
+			metricStore.Report(metric.Key("dns_success", r.Resolver, r.Name), success)
+			metricStore.Report(metric.Key("dns_answers", r.Resolver, r.Name), float64(len(r.Answers)))
+		},
+		ReportConsistency: func(c *science.DNSConsistency) {
+			metricStore.Report(metric.Key("dns_disagreements", c.Resolver, c.Name), float64(len(c.Disagree)))
+		},
+	}
+
+	dnsLatestHandler := &handler.MetricsData{
+		Logger:         logger,
+		SnapshotGetter: func() interface{} { return dnsExperiment.Latest() },
+	}
+
+	dnsConsistencyHandler := &handler.MetricsData{
+		Logger:         logger,
+		SnapshotGetter: func() interface{} { return dnsExperiment.Consistency() },
+	}
+
+	loadClient, _ := experimentClients("load")
+	loadSuffix := dialSuffix(config.DialOptions["load"])
+	loadExperiment := &science.LoadExperiment{
+		Peers:         peers,
+		Logger:        logger,
+		CheckInterval: config.TTL,
+		Client:        loadClient,
+		Budget:        trafficBudget,
+		Limiter:       limiter,
+		Rate:          config.LoadRate,
+		Concurrency:   config.LoadConcurrency,
+		Duration:      config.LoadDuration,
+		RequestSize:   config.LoadRequestSize,
+		ResponseSize:  config.LoadResponseSize,
+		Timeout:       config.TTL,
+
+		ReportResult: func(r *science.LoadResult) {
+			metricStore.Report(metric.Key("load_latency_median"+loadSuffix, r.Target), r.Latency.Median)
+			metricStore.Report(metric.Key("load_latency_p95"+loadSuffix, r.Target), r.Latency.P95)
+			metricStore.Report(metric.Key("load_latency_p99"+loadSuffix, r.Target), r.Latency.P99)
+			metricStore.Report(metric.Key("load_error_rate"+loadSuffix, r.Target), r.ErrorRate)
+			metricStore.Report(metric.Key("load_throughput"+loadSuffix, r.Target), r.Throughput)
+			metricStore.Report(metric.Key("load_missed"+loadSuffix, r.Target), float64(r.Missed))
+		},
+	}
+
+	echoHandler := &handler.Echo{
+		Logger:  logger,
+		MaxSize: config.MaxPayloadSize,
+	}
+
+	statusHandler := &handler.MetricsData{
+		Logger:         logger,
+		SnapshotGetter: func() interface{} { return scheduler.Status() },
+	}
+
+	pauseHandler := &handler.ExperimentControl{
+		Logger:      logger,
+		Controller:  scheduler,
+		Pause:       true,
+		AllowedCIDR: config.AllowedPeers,
+	}
+
+	resumeHandler := &handler.ExperimentControl{
+		Logger:      logger,
+		Controller:  scheduler,
+		AllowedCIDR: config.AllowedPeers,
+	}
+
+	jobs := job.NewStore()
+	triggerable := map[string]handler.Triggerable{
+		"bandwidth": bandwidthExperiment,
+		"latency":   latencyExperiment,
+	}
+	if config.LoadRate > 0 {
+		triggerable["load"] = loadExperiment
+	}
+
+	triggerHandler := &handler.ExperimentTrigger{
+		Logger:         logger,
+		Experiments:    triggerable,
+		Jobs:           jobs,
+		Peers:          peers,
+		MaxPayloadSize: config.MaxPayloadSize,
+		AllowedCIDR:    config.AllowedPeers,
+	}
+
+	jobStatusHandler := &handler.JobStatus{
+		Logger: logger,
+		Jobs:   jobs,
+	}
+
+	budgetHandler := &handler.MetricsData{
+		Logger:         logger,
+		SnapshotGetter: func() interface{} { return trafficBudget.Usage() },
 	}
 
 	routes := rata.Routes{
@@ -119,26 +682,113 @@ func main() {
 		{Name: "metrics_display", Method: "GET", Path: "/metrics"},
 		{Name: "metrics_display", Method: "GET", Path: "/"},
 		{Name: "bandwidth", Method: "POST", Path: "/bandwidth"},
+		{Name: "bandwidth_source", Method: "GET", Path: "/bandwidth"},
+		{Name: "bandwidth_latest", Method: "GET", Path: "/bandwidth/latest"},
+		{Name: "bandwidth_lease", Method: "POST", Path: "/bandwidth/lease"},
+		{Name: "bandwidth_lease", Method: "DELETE", Path: "/bandwidth/lease"},
+		{Name: "alerts", Method: "GET", Path: "/alerts"},
+		{Name: "reachability", Method: "GET", Path: "/reachability"},
+		{Name: "clock", Method: "GET", Path: "/clock"},
+		{Name: "clock_history", Method: "GET", Path: "/clock/history"},
+		{Name: "idle_latest", Method: "GET", Path: "/idle/latest"},
+		{Name: "probes_latest", Method: "GET", Path: "/probes/latest"},
+		{Name: "dns_latest", Method: "GET", Path: "/dns/latest"},
+		{Name: "dns_consistency", Method: "GET", Path: "/dns/consistency"},
+		{Name: "echo", Method: "GET", Path: "/echo"},
+		{Name: "echo", Method: "POST", Path: "/echo"},
+		{Name: "budget", Method: "GET", Path: "/budget"},
+		{Name: "status", Method: "GET", Path: "/status"},
+		{Name: "experiments_pause", Method: "POST", Path: "/experiments/pause"},
+		{Name: "experiments_resume", Method: "POST", Path: "/experiments/resume"},
+		{Name: "experiment_pause", Method: "POST", Path: "/experiments/:name/pause"},
+		{Name: "experiment_resume", Method: "POST", Path: "/experiments/:name/resume"},
+		{Name: "experiment_run", Method: "POST", Path: "/experiments/:name/run"},
+		{Name: "job_status", Method: "GET", Path: "/jobs/:id"},
 	}
 
 	handlers := rata.Handlers{
-		"peers_list":      peerListHandler,
-		"peers_upsert":    peerPostHandler,
-		"metrics_data":    gziphandler.GzipHandler(metricsDataHandler),
-		"metrics_display": gziphandler.GzipHandler(metricsDisplayHandler),
-		"bandwidth":       bandwidthHandler,
+		"peers_list":       peerListHandler,
+		"peers_upsert":     peerPostHandler,
+		"metrics_data":     gziphandler.GzipHandler(metricsDataHandler),
+		"metrics_display":  gziphandler.GzipHandler(metricsDisplayHandler),
+		"bandwidth":        bandwidthHandler,
+		"bandwidth_source": bandwidthSourceHandler,
+		"bandwidth_latest": bandwidthLatestHandler,
+		"bandwidth_lease":  bandwidthLeaseHandler,
+		"alerts":           alertsHandler,
+		"reachability":     reachabilityHandler,
+		"clock":            clockHandler,
+		"clock_history":    clockHistoryHandler,
+		"idle_latest":      idleLatestHandler,
+		"probes_latest":    probesLatestHandler,
+		"dns_latest":       dnsLatestHandler,
+		"dns_consistency":  dnsConsistencyHandler,
+		"echo":             echoHandler,
+		"budget":           budgetHandler,
+		"status":           statusHandler,
+
+		"experiments_pause":  pauseHandler,
+		"experiments_resume": resumeHandler,
+		"experiment_pause":   pauseHandler,
+		"experiment_resume":  resumeHandler,
+		"experiment_run":     triggerHandler,
+		"job_status":         jobStatusHandler,
 	}
 	router, err := rata.NewRouter(routes, handlers)
 	if err != nil {
 		logger.Fatal("new-router", err)
 	}
 
-	httpServer := http_server.New(fmt.Sprintf("%s:%d", "0.0.0.0", config.Port), router)
+	httpServer := &server.Server{
+		Address: fmt.Sprintf("%s:%d", "0.0.0.0", config.Port),
+		Handler: router,
+	}
 	members := grouper.Members{
 		{"http_server", httpServer},
+	}
+	if dataPlaneServer != nil {
+		members = append(members, grouper.Member{"dataplane_server", dataPlaneServer})
+	}
+	if udpServer != nil {
+		members = append(members, grouper.Member{"udp_echo_server", udpServer})
+	}
+	members = append(members, grouper.Members{
 		{"list_culler", ifrit.RunFunc(peers.RunCullerLoop)},
 		{"heart_beater", ifrit.RunFunc(heartbeat.RunHeartbeat)},
 		{"bandwidth_experiment", bandwidthExperiment},
+		{"latency_experiment", latencyExperiment},
+		{"clock_experiment", clockExperiment},
+	}...)
+	if len(config.Reachability) > 0 {
+		reachabilityExperiment.Gate = scheduler.Gate("reachability")
+		members = append(members, grouper.Member{"reachability_experiment", reachabilityExperiment})
+	}
+	if idleExperiment != nil {
+		members = append(members, grouper.Member{"idle_experiment", idleExperiment})
+	}
+	if config.Leader != "" {
+		routingExperiment.Gate = scheduler.Gate("routing")
+		members = append(members, grouper.Member{"routing_experiment", routingExperiment})
+	}
+	if len(config.ProbeTargets) > 0 {
+		probeExperiment.Gate = scheduler.Gate("probe")
+		members = append(members, grouper.Member{"probe_experiment", probeExperiment})
+	}
+	if len(config.DNSNames) > 0 {
+		dnsExperiment.Gate = scheduler.Gate("dns")
+		members = append(members, grouper.Member{"dns_experiment", dnsExperiment})
+	}
+	if config.LoadRate > 0 {
+		loadExperiment.Gate = scheduler.Gate("load")
+		members = append(members, grouper.Member{"load_experiment", loadExperiment})
+	}
+	if udpExperiment != nil {
+		members = append(members, grouper.Member{"udp_experiment", udpExperiment})
+		if udpecho.DontFragmentSupported {
+			members = append(members, grouper.Member{"mtu_experiment", mtuExperiment})
+		} else {
+			logger.Info("mtu-experiment-unsupported")
+		}
 	}
 
 	monitor := ifrit.Invoke(sigmon.New(grouper.NewOrdered(os.Interrupt, members)))
@@ -1,12 +1,21 @@
 package metric
 
-import "sync"
+import (
+	"strings"
+	"sync"
+)
 
 type Store interface {
 	Report(name string, value float64)
 	Snapshot() map[string][]float64
 }
 
+// Key joins a metric name with its labels, most general first,
+// e.g. Key("latency_p95", "keepalive", "10.255.0.3")
+func Key(name string, labels ...string) string {
+	return strings.Join(append([]string{name}, labels...), "/")
+}
+
 func NewStore(maxCapacity int) Store {
 	return &metricStore{
 		lock:        &sync.Mutex{},
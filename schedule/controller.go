@@ -0,0 +1,186 @@
+package schedule
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrUnknownExperiment = errors.New("unknown experiment")
+
+// State is where one experiment stands on this node.  Runnable is what the
+// next scheduled run will find: in one of its windows, if it has any, and
+// not paused.
+type State struct {
+	Experiment string     `json:"experiment"`
+	Windows    []string   `json:"windows,omitempty"`
+	InWindow   bool       `json:"in_window"`
+	Paused     bool       `json:"paused"`
+	Runnable   bool       `json:"runnable"`
+	Runs       int        `json:"runs"`
+	Skipped    int        `json:"skipped"`
+	LastRun    *time.Time `json:"last_run,omitempty"`
+}
+
+type Status struct {
+	Host        string    `json:"host"`
+	Time        time.Time `json:"time"`
+	PausedAll   bool      `json:"paused_all"`
+	Experiments []State   `json:"experiments"`
+}
+
+// Gate is consulted by an experiment before each run
+type Gate interface {
+	Open() bool
+}
+
+// Controller keeps the schedule and pause state of every experiment that
+// has asked for a Gate
+type Controller interface {
+	Gate(experiment string) Gate
+	Pause(experiment string) error
+	Resume(experiment string) error
+	PauseAll()
+	ResumeAll()
+	Status() Status
+}
+
+// NewController schedules experiments within windows, keyed by experiment
+// name.  An experiment without windows may run at any time.
+func NewController(host string, windows map[string][]*Window) Controller {
+	return &controller{
+		lock:        &sync.Mutex{},
+		host:        host,
+		windows:     windows,
+		experiments: make(map[string]*experimentState),
+	}
+}
+
+type experimentState struct {
+	paused  bool
+	runs    int
+	skipped int
+	lastRun time.Time
+}
+
+type controller struct {
+	lock        *sync.Mutex
+	host        string
+	windows     map[string][]*Window
+	pausedAll   bool
+	experiments map[string]*experimentState
+}
+
+type gate struct {
+	controller *controller
+	experiment string
+}
+
+func (g *gate) Open() bool {
+	return g.controller.open(g.experiment, time.Now())
+}
+
+func (c *controller) Gate(experiment string) Gate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.experiments[experiment]; !ok {
+		c.experiments[experiment] = &experimentState{}
+	}
+	return &gate{controller: c, experiment: experiment}
+}
+
+func (c *controller) open(experiment string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s := c.experiments[experiment]
+	if !c.runnable(experiment, s, now) {
+		s.skipped++
+		return false
+	}
+	s.runs++
+	s.lastRun = now
+	return true
+}
+
+func (c *controller) inWindow(experiment string, now time.Time) bool {
+	windows := c.windows[experiment]
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *controller) runnable(experiment string, s *experimentState, now time.Time) bool {
+	return !c.pausedAll && !s.paused && c.inWindow(experiment, now)
+}
+
+func (c *controller) setPaused(experiment string, paused bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s, ok := c.experiments[experiment]
+	if !ok {
+		return ErrUnknownExperiment
+	}
+	s.paused = paused
+	return nil
+}
+
+func (c *controller) Pause(experiment string) error {
+	return c.setPaused(experiment, true)
+}
+
+func (c *controller) Resume(experiment string) error {
+	return c.setPaused(experiment, false)
+}
+
+// PauseAll holds every experiment without touching their own pause state,
+// so that ResumeAll puts things back as they were
+func (c *controller) PauseAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pausedAll = true
+}
+
+func (c *controller) ResumeAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pausedAll = false
+}
+
+func (c *controller) Status() Status {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	status := Status{Host: c.host, Time: now, PausedAll: c.pausedAll, Experiments: []State{}}
+	for name, s := range c.experiments {
+		state := State{
+			Experiment: name,
+			InWindow:   c.inWindow(name, now),
+			Paused:     s.paused,
+			Runnable:   c.runnable(name, s, now),
+			Runs:       s.runs,
+			Skipped:    s.skipped,
+		}
+		for _, w := range c.windows[name] {
+			state.Windows = append(state.Windows, w.String())
+		}
+		if !s.lastRun.IsZero() {
+			lastRun := s.lastRun
+			state.LastRun = &lastRun
+		}
+		status.Experiments = append(status.Experiments, state)
+	}
+	sort.Slice(status.Experiments, func(i, j int) bool {
+		return status.Experiments[i].Experiment < status.Experiments[j].Experiment
+	})
+	return status
+}
@@ -0,0 +1,128 @@
+// Package schedule decides when experiments may run: inside their
+// configured windows, and not while an operator has paused them.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a cron expression read as a set of minutes, so that
+// "* 1-5 * * 1-5" is open from 01:00 to 05:59 on weekdays.  Times are the
+// node's local time, which on most platforms is UTC.
+type Window struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+type field struct {
+	min, max int
+}
+
+var fields = []field{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, with 0 and 7 both Sunday
+}
+
+// ParseWindow reads the five standard cron fields.  Each is *, a number, a
+// range a-b, any of those with a /step, or a comma separated list of them.
+// A number with a step, a/step, starts at a and runs to the end of the
+// field's range.
+func ParseWindow(spec string) (*Window, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("window %q: want %d fields, got %d", spec, len(fields), len(parts))
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, part := range parts {
+		var err error
+		if sets[i], err = parseField(part, fields[i]); err != nil {
+			return nil, fmt.Errorf("window %q: %s", spec, err)
+		}
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &Window{
+		spec:   spec,
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: parts[2] == "*",
+		dowAny: parts[4] == "*",
+	}, nil
+}
+
+func parseField(s string, f field) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(s, ",") {
+		step, stepped := 1, false
+		if i := strings.Index(item, "/"); i >= 0 {
+			stepped = true
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in %q", item)
+			}
+			item = item[:i]
+		}
+
+		lo, hi := f.min, f.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", item)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", item)
+				}
+			} else if stepped {
+				// as in cron, a/step runs from a to the end of the range
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", item, f.min, f.max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// Contains reports whether t falls in the window.  As in cron, when both
+// day of month and day of week are restricted, either one matching will do.
+func (w *Window) Contains(t time.Time) bool {
+	if w.minute&(1<<uint(t.Minute())) == 0 ||
+		w.hour&(1<<uint(t.Hour())) == 0 ||
+		w.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dom := w.dom&(1<<uint(t.Day())) != 0
+	dow := w.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case w.domAny && w.dowAny:
+		return true
+	case w.domAny:
+		return dow
+	case w.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func (w *Window) String() string {
+	return w.spec
+}
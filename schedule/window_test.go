@@ -0,0 +1,126 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func bits(values ...int) uint64 {
+	var set uint64
+	for _, v := range values {
+		set |= 1 << uint(v)
+	}
+	return set
+}
+
+func TestParseWindow(t *testing.T) {
+	cases := []struct {
+		spec   string
+		minute uint64
+		hour   uint64
+		dow    uint64
+	}{
+		{"* * * * *", bits(seq(0, 59, 1)...), bits(seq(0, 23, 1)...), bits(seq(0, 7, 1)...)},
+		{"5 * * * *", bits(5), bits(seq(0, 23, 1)...), bits(seq(0, 7, 1)...)},
+		{"5/15 * * * *", bits(5, 20, 35, 50), bits(seq(0, 23, 1)...), bits(seq(0, 7, 1)...)},
+		{"*/20 1-5 * * *", bits(0, 20, 40), bits(1, 2, 3, 4, 5), bits(seq(0, 7, 1)...)},
+		{"10-30/10 1,3 * * *", bits(10, 20, 30), bits(1, 3), bits(seq(0, 7, 1)...)},
+		{"0 22/2 * * *", bits(0), bits(22), bits(seq(0, 7, 1)...)},
+		{"0 0 * * 1-5", bits(0), bits(0), bits(1, 2, 3, 4, 5)},
+		{"0 0 * * 7", bits(0), bits(0), bits(0, 7)},
+		{"0 0 * * 5/1", bits(0), bits(0), bits(0, 5, 6, 7)},
+	}
+	for _, c := range cases {
+		w, err := ParseWindow(c.spec)
+		if err != nil {
+			t.Errorf("%q: %s", c.spec, err)
+			continue
+		}
+		if w.minute != c.minute {
+			t.Errorf("%q: minutes %b, want %b", c.spec, w.minute, c.minute)
+		}
+		if w.hour != c.hour {
+			t.Errorf("%q: hours %b, want %b", c.spec, w.hour, c.hour)
+		}
+		if w.dow != c.dow {
+			t.Errorf("%q: days of week %b, want %b", c.spec, w.dow, c.dow)
+		}
+	}
+}
+
+func TestParseWindowErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	} {
+		if _, err := ParseWindow(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	// 2026-10-18 is a Sunday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.October, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		spec string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", at(18, 12, 30), true},
+		{"* 1-5 * * *", at(18, 1, 0), true},
+		{"* 1-5 * * *", at(18, 5, 59), true},
+		{"* 1-5 * * *", at(18, 6, 0), false},
+		{"5/15 * * * *", at(18, 12, 50), true},
+		{"5/15 * * * *", at(18, 12, 51), false},
+		{"* * * 10 *", at(18, 0, 0), true},
+		{"* * * 11 *", at(18, 0, 0), false},
+
+		// 7 and 0 are both Sunday
+		{"* * * * 7", at(18, 0, 0), true},
+		{"* * * * 0", at(18, 0, 0), true},
+		{"* * * * 7", at(19, 0, 0), false},
+
+		// day of month or day of week alone
+		{"* * 18 * *", at(18, 0, 0), true},
+		{"* * 18 * *", at(19, 0, 0), false},
+		{"* * * * 1-5", at(19, 0, 0), true},
+		{"* * * * 1-5", at(18, 0, 0), false},
+
+		// both restricted, so either one matching will do
+		{"* * 1 * 1", at(19, 0, 0), true},
+		{"* * 18 * 1", at(18, 0, 0), true},
+		{"* * 1 * 1", at(18, 0, 0), false},
+	}
+	for _, c := range cases {
+		w, err := ParseWindow(c.spec)
+		if err != nil {
+			t.Errorf("%q: %s", c.spec, err)
+			continue
+		}
+		if got := w.Contains(c.t); got != c.want {
+			t.Errorf("%q contains %s: got %t, want %t", c.spec, c.t.Format(time.RFC1123), got, c.want)
+		}
+	}
+}
+
+func seq(lo, hi, step int) []int {
+	var values []int
+	for v := lo; v <= hi; v += step {
+		values = append(values, v)
+	}
+	return values
+}
@@ -0,0 +1,144 @@
+package science
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// ErrBusy is what a peer says when it is already serving another node's
+// bandwidth test
+var ErrBusy = errors.New("peer busy with another bandwidth test")
+
+// LeaseHeader carries the token a lease was granted with, so that a test
+// can be matched to its lease whatever address it arrives from, as a test
+// that came through the platform router does
+const LeaseHeader = "X-Reflex-Lease"
+
+// Admission lets one peer at a time run bandwidth tests against this node,
+// so that concurrent tests from different nodes don't skew each other.
+// A holder keeps the node for as long as it has tests in flight, or until
+// its lease runs out, whichever is later.  The same holder may run several
+// tests at once, as parallel streams and bidirectional tests do.  A lease
+// comes with a token, which Holder turns back into its holder for as long
+// as the lease lasts; renewing a lease keeps its token.
+type Admission interface {
+	Lease(holder string, ttl time.Duration) (string, time.Time, bool)
+	Release(holder string)
+	Holder(token string) (string, bool)
+	Enter(holder string) bool
+	Exit(holder string)
+}
+
+// withLease calls fn while holding a lease on target, or just calls it when
+// lessor is nil.  A target that is busy answers ErrBusy and fn is not called.
+func withLease(logger lager.Logger, lessor leaseClient, ttl time.Duration, target string, fn func()) error {
+	if lessor == nil {
+		fn()
+		return nil
+	}
+	if err := lessor.AcquireLease(logger, target, ttl); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lessor.ReleaseLease(logger, target); err != nil {
+			logger.Error("release-lease", err)
+		}
+	}()
+	fn()
+	return nil
+}
+
+func NewAdmission() Admission {
+	return &admission{lock: &sync.Mutex{}}
+}
+
+type admission struct {
+	lock       *sync.Mutex
+	holder     string
+	token      string
+	leaseUntil time.Time
+	inFlight   int
+}
+
+// busy must be called with the lock held
+func (a *admission) busy(holder string) bool {
+	if a.holder == "" || a.holder == holder {
+		return false
+	}
+	if a.inFlight > 0 || time.Now().Before(a.leaseUntil) {
+		return true
+	}
+	a.holder, a.token = "", ""
+	return false
+}
+
+func (a *admission) Lease(holder string, ttl time.Duration) (string, time.Time, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.busy(holder) {
+		return "", time.Time{}, false
+	}
+	if a.holder != holder || a.token == "" {
+		a.token = newLeaseToken()
+	}
+	a.holder = holder
+	a.leaseUntil = time.Now().Add(ttl)
+	return a.token, a.leaseUntil, true
+}
+
+func (a *admission) Holder(token string) (string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if token == "" || token != a.token || !a.busy("") {
+		return "", false
+	}
+	return a.holder, true
+}
+
+// newLeaseToken is unguessable, since it stands in for the holder's address
+func newLeaseToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+func (a *admission) Release(holder string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.holder != holder {
+		return
+	}
+	a.leaseUntil = time.Time{}
+	a.token = ""
+	if a.inFlight == 0 {
+		a.holder = ""
+	}
+}
+
+func (a *admission) Enter(holder string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.busy(holder) {
+		return false
+	}
+	a.holder = holder
+	a.inFlight++
+	return true
+}
+
+func (a *admission) Exit(holder string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.holder != holder {
+		return
+	}
+	a.inFlight--
+	if a.inFlight == 0 && time.Now().After(a.leaseUntil) {
+		a.holder, a.token = "", ""
+	}
+}
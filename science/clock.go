@@ -0,0 +1,177 @@
+package science
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rosenhouse/reflex/alert"
+	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	AlertClockOffset = "clock-offset"
+	AlertClockDrift  = "clock-drift"
+)
+
+const (
+	// clockSamples is how many exchanges go into each estimate.  Like NTP's
+	// clock filter, the one with the least delay is kept, since queueing
+	// makes the others asymmetric.
+	clockSamples = 8
+
+	// clockDriftMinSpan is how much history drift needs before it means
+	// anything.  Over a few seconds a millisecond of jitter in the offset
+	// looks like hundreds of ppm.
+	clockDriftMinSpan = 10 * time.Minute
+
+	// clockHistoryAge is how far back estimates are kept for each peer,
+	// with room to spare over clockDriftMinSpan
+	clockHistoryAge = 2 * clockDriftMinSpan
+
+	// clockHistoryLength bounds the estimates kept for each peer however
+	// often they come, a run every half second for clockHistoryAge
+	clockHistoryLength = 2400
+)
+
+// ClockTimestamps is a peer's half of a timestamp exchange, in Unix
+// nanoseconds on its own clock
+type ClockTimestamps struct {
+	Receive  int64 `json:"receive"`
+	Transmit int64 `json:"transmit"`
+}
+
+// ClockSample is one exchange, in seconds.  Offset is positive when the
+// peer's clock is ahead of ours.
+type ClockSample struct {
+	Offset float64 `json:"offset"`
+	Delay  float64 `json:"delay"`
+}
+
+// ClockEstimate is the best sample of a burst.  Drift is the change in
+// offset over the history so far, in seconds per second, and stays zero
+// until the history spans clockDriftMinSpan.
+type ClockEstimate struct {
+	Time time.Time `json:"time"`
+	ClockSample
+	Drift float64 `json:"drift"`
+}
+
+type clockClient interface {
+	ExchangeTimestamps(logger lager.Logger, host string) (ClockSample, error)
+}
+
+type ClockExperiment struct {
+	Peers         peer.List
+	Logger        lager.Logger
+	CheckInterval time.Duration
+	Gate          schedule.Gate
+	Client        clockClient
+	Alerts        alert.Board
+	MaxOffset     time.Duration
+
+	// MaxDrift is in seconds per second; zero means drift is not alerted on
+	MaxDrift float64
+
+	ReportEstimate func(target string, estimate ClockEstimate)
+
+	historyLock sync.Mutex
+	history     map[string][]ClockEstimate
+}
+
+func (c *ClockExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	return runJittered(c.Logger, c.CheckInterval, c.Gate, signals, ready, c.run)
+}
+
+func (c *ClockExperiment) run() {
+	logger := c.Logger.Session("clock-experiment")
+	defer logger.Debug("done")
+
+	for _, candidate := range c.Peers.Snapshot(logger) {
+		targetLogger := logger.WithData(lager.Data{"target": candidate.Host})
+		best, err := c.burst(targetLogger, candidate.Host)
+		if err != nil {
+			targetLogger.Error("exchange-timestamps", err)
+			continue
+		}
+
+		estimate := c.record(candidate.Host, ClockEstimate{Time: time.Now(), ClockSample: best})
+		if math.Abs(estimate.Offset) > c.MaxOffset.Seconds() {
+			c.Alerts.Raise(targetLogger, AlertClockOffset, candidate.Host, fmt.Sprintf(
+				"clock offset %s is more than %s", time.Duration(estimate.Offset*float64(time.Second)), c.MaxOffset))
+		} else {
+			c.Alerts.Clear(targetLogger, AlertClockOffset, candidate.Host)
+		}
+		if c.MaxDrift > 0 && math.Abs(estimate.Drift) > c.MaxDrift {
+			c.Alerts.Raise(targetLogger, AlertClockDrift, candidate.Host, fmt.Sprintf(
+				"clock drift %.0f ppm is more than %.0f ppm", estimate.Drift*1e6, c.MaxDrift*1e6))
+		} else {
+			c.Alerts.Clear(targetLogger, AlertClockDrift, candidate.Host)
+		}
+
+		targetLogger.Debug("estimate", lager.Data{"estimate": estimate})
+		c.ReportEstimate(candidate.Host, estimate)
+	}
+}
+
+func (c *ClockExperiment) burst(logger lager.Logger, target string) (ClockSample, error) {
+	var best ClockSample
+	for i := 0; i < clockSamples; i++ {
+		sample, err := c.Client.ExchangeTimestamps(logger, target)
+		if err != nil {
+			return ClockSample{}, err
+		}
+		if i == 0 || sample.Delay < best.Delay {
+			best = sample
+		}
+	}
+	return best, nil
+}
+
+// record appends estimate to the target's history, working out its drift
+// against the oldest estimate kept
+func (c *ClockExperiment) record(target string, estimate ClockEstimate) ClockEstimate {
+	c.historyLock.Lock()
+	defer c.historyLock.Unlock()
+
+	if c.history == nil {
+		c.history = make(map[string][]ClockEstimate)
+	}
+	h := c.history[target]
+	if len(h) > 0 {
+		oldest := h[0]
+		if elapsed := estimate.Time.Sub(oldest.Time); elapsed >= clockDriftMinSpan {
+			estimate.Drift = (estimate.Offset - oldest.Offset) / elapsed.Seconds()
+		}
+	}
+
+	// keep one estimate from before the cutoff, so that however far apart
+	// they are the history still spans clockHistoryAge
+	h = append(h, estimate)
+	cutoff := estimate.Time.Add(-clockHistoryAge)
+	for len(h) > 1 && h[1].Time.Before(cutoff) {
+		h = h[1:]
+	}
+	if len(h) > clockHistoryLength {
+		h = h[len(h)-clockHistoryLength:]
+	}
+	c.history[target] = h
+	return estimate
+}
+
+// History returns the estimates kept for each peer, oldest first
+func (c *ClockExperiment) History() map[string][]ClockEstimate {
+	c.historyLock.Lock()
+	defer c.historyLock.Unlock()
+
+	ret := make(map[string][]ClockEstimate)
+	for k, v := range c.history {
+		ret[k] = append([]ClockEstimate(nil), v...)
+	}
+	return ret
+}
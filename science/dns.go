@@ -0,0 +1,171 @@
+package science
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// ResolverSystem names the platform's own resolver, as configured in
+// /etc/resolv.conf
+const ResolverSystem = "system"
+
+// DNSResult is one resolution of Name through Resolver.  Latency is in
+// seconds and Answers are sorted.
+type DNSResult struct {
+	Name     string    `json:"name"`
+	Resolver string    `json:"resolver"`
+	Time     time.Time `json:"time"`
+	Latency  float64   `json:"latency"`
+	Rcode    string    `json:"rcode"`
+	Answers  []string  `json:"answers"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (r *DNSResult) key() string {
+	return r.Resolver + " " + r.Name
+}
+
+// DNSConsistency compares one name and resolver as seen from here with the
+// latest results of every other node.  Disagree maps each peer whose
+// answers or rcode differ to what it saw.
+type DNSConsistency struct {
+	Name     string                `json:"name"`
+	Resolver string                `json:"resolver"`
+	Rcode    string                `json:"rcode"`
+	Answers  []string              `json:"answers"`
+	Agree    []string              `json:"agree"`
+	Disagree map[string]*DNSResult `json:"disagree,omitempty"`
+}
+
+type dnsClient interface {
+	LookupDNS(logger lager.Logger, resolver, name string, timeout time.Duration) (rcode string, answers []string, err error)
+	ReadDNSResults(logger lager.Logger, host string) ([]*DNSResult, error)
+}
+
+// DNSExperiment resolves every name through every resolver, then compares
+// the answers with what the other nodes last got
+type DNSExperiment struct {
+	Peers         peer.List
+	Logger        lager.Logger
+	CheckInterval time.Duration
+	Gate          schedule.Gate
+	Client        dnsClient
+	Source        string
+	Names         []string
+	Resolvers     []string
+	Timeout       time.Duration
+
+	ReportResult      func(result *DNSResult)
+	ReportConsistency func(report *DNSConsistency)
+
+	latestLock  sync.Mutex
+	latest      []*DNSResult
+	consistency []*DNSConsistency
+}
+
+func (d *DNSExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	return runJittered(d.Logger, d.CheckInterval, d.Gate, signals, ready, d.run)
+}
+
+func (d *DNSExperiment) run() {
+	logger := d.Logger.Session("dns-experiment")
+	defer logger.Debug("done")
+
+	var results []*DNSResult
+	for _, resolver := range d.Resolvers {
+		for _, name := range d.Names {
+			r := d.resolve(logger.WithData(lager.Data{"name": name, "resolver": resolver}), resolver, name)
+			d.ReportResult(r)
+			results = append(results, r)
+		}
+	}
+
+	d.latestLock.Lock()
+	d.latest = results
+	d.latestLock.Unlock()
+
+	reports := make(map[string]*DNSConsistency)
+	var ordered []*DNSConsistency
+	for _, r := range results {
+		c := &DNSConsistency{Name: r.Name, Resolver: r.Resolver, Rcode: r.Rcode, Answers: r.Answers, Agree: []string{}}
+		reports[r.key()] = c
+		ordered = append(ordered, c)
+	}
+
+	for _, candidate := range d.Peers.Snapshot(logger) {
+		if candidate.Host == d.Source {
+			continue
+		}
+		theirs, err := d.Client.ReadDNSResults(logger, candidate.Host)
+		if err != nil {
+			logger.Error("read-peer-results", err, lager.Data{"peer": candidate.Host})
+			continue
+		}
+		for _, r := range theirs {
+			c, ok := reports[r.key()]
+			if !ok {
+				continue
+			}
+			if r.Rcode == c.Rcode && sameAnswers(r.Answers, c.Answers) {
+				c.Agree = append(c.Agree, candidate.Host)
+				continue
+			}
+			if c.Disagree == nil {
+				c.Disagree = make(map[string]*DNSResult)
+			}
+			c.Disagree[candidate.Host] = r
+		}
+	}
+
+	for _, c := range ordered {
+		if len(c.Disagree) > 0 {
+			logger.Info("disagreement", lager.Data{"report": c})
+		}
+		d.ReportConsistency(c)
+	}
+
+	d.latestLock.Lock()
+	defer d.latestLock.Unlock()
+	d.consistency = ordered
+}
+
+func (d *DNSExperiment) resolve(logger lager.Logger, resolver, name string) *DNSResult {
+	r := &DNSResult{Name: name, Resolver: resolver, Time: time.Now(), Answers: []string{}}
+	rcode, answers, err := d.Client.LookupDNS(logger, resolver, name, d.Timeout)
+	r.Latency = time.Since(r.Time).Seconds()
+	r.Rcode = rcode
+	if answers != nil {
+		r.Answers = answers
+	}
+	if err != nil {
+		r.Error = err.Error()
+		logger.Error("lookup", err, lager.Data{"rcode": rcode})
+	}
+	return r
+}
+
+func sameAnswers(a, b []string) bool {
+	return strings.Join(a, ",") == strings.Join(b, ",")
+}
+
+// Latest returns this node's most recent results, for the other nodes to
+// compare against
+func (d *DNSExperiment) Latest() []*DNSResult {
+	d.latestLock.Lock()
+	defer d.latestLock.Unlock()
+	return d.latest
+}
+
+// Consistency returns the most recent comparison with the other nodes
+func (d *DNSExperiment) Consistency() []*DNSConsistency {
+	d.latestLock.Lock()
+	defer d.latestLock.Unlock()
+	return d.consistency
+}
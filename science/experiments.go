@@ -2,53 +2,179 @@ package science
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/rosenhouse/reflex/alert"
+	"github.com/rosenhouse/reflex/budget"
 	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
+	"github.com/rosenhouse/reflex/tcpinfo"
 
 	"code.cloudfoundry.org/lager"
 )
 
+const (
+	DirectionUpload        = "upload"
+	DirectionDownload      = "download"
+	DirectionBidirectional = "bidirectional"
+)
+
 type BandwidthExperimentResult struct {
+	Transport       string  `json:"transport"`
+	Protocol        string  `json:"protocol,omitempty"`
+	Direction       string  `json:"direction"`
+	Bidirectional   bool    `json:"bidirectional"`
+	Kind            string  `json:"kind,omitempty"`
+	Encoding        string  `json:"encoding,omitempty"`
 	NumBytes        int64   `json:"num_bytes"`
+	WireBytes       int64   `json:"wire_bytes,omitempty"`
 	DurationSeconds float64 `json:"duration_seconds"`
 	AvgBandwidth    float64 `json:"avg_bandwidth"`
-	SHA256          string  `json:"sha256"`
+
+	// RelativeBandwidth compares a non-random payload with a random one
+	// sent the same way in the same run
+	RelativeBandwidth float64 `json:"relative_bandwidth,omitempty"`
+
+	Integrity
+
+	// RampUp is the throughput curve over the test, or over successive
+	// tests when the payload size is chosen adaptively
+	RampUp []RampPoint `json:"ramp_up,omitempty"`
+
+	// TCP statistics from each end of the connection, where available
+	ClientTCPInfo *tcpinfo.Stats `json:"client_tcp_info,omitempty"`
+	ServerTCPInfo *tcpinfo.Stats `json:"server_tcp_info,omitempty"`
+
+	// Streams is only set on the aggregate of a parallel test
+	Streams *StreamSummary `json:"streams,omitempty"`
+}
+
+const (
+	TransportHTTP = "http"
+	TransportTCP  = "tcp"
+)
+
+// Protocols are named as in http.Request.Proto
+const (
+	ProtocolHTTP1 = "HTTP/1.1"
+	ProtocolHTTP2 = "HTTP/2.0"
+)
+
+const (
+	SizingFixed    = "fixed"
+	SizingDuration = "duration"
+	SizingAdaptive = "adaptive"
+)
+
+// Experiments are charged to the budget under these names
+const (
+	budgetBandwidth = "bandwidth"
+	budgetRouting   = "routing"
+	budgetLoad      = "load"
+)
+
+const (
+	AlertPayloadCorruption = "payload-corruption"
+	AlertCompression       = "suspected-compression"
+	AlertCoverage          = "coverage-overdue"
+)
+
+// compressionSuspicion is how much faster a compressible payload has to go
+// than a random one, with no compression of our own, before something on
+// the path is suspected of compressing it
+const compressionSuspicion = 1.5
+
+// adaptiveTolerance is how close, as a fraction, the throughput of two
+// successive adaptive tests must be before the size is considered large enough
+const adaptiveTolerance = 0.1
+
+// ServerTCPInfoTrailer carries the source's TCP statistics at the end of a
+// download, since only then does the source know them.
+const ServerTCPInfoTrailer = "X-Reflex-Server-Tcp-Info"
+
+// SenderTCPInfo returns the statistics from the sending end, which is where
+// the congestion window, pacing and retransmits are meaningful
+func (r *BandwidthExperimentResult) SenderTCPInfo() *tcpinfo.Stats {
+	if r.Direction == DirectionDownload {
+		return r.ServerTCPInfo
+	}
+	return r.ClientTCPInfo
 }
 
 type scienceClient interface {
-	TestBandwidth(logger lager.Logger, host string, payloadSize int64) (*BandwidthExperimentResult, error)
+	TestBandwidth(logger lager.Logger, host string, spec BandwidthSpec) (*BandwidthExperimentResult, error)
+	TestDownload(logger lager.Logger, host string, spec BandwidthSpec) (*BandwidthExperimentResult, error)
+}
+
+type leaseClient interface {
+	AcquireLease(logger lager.Logger, host string, ttl time.Duration) error
+	ReleaseLease(logger lager.Logger, host string) error
 }
 
+type bandwidthTest func(logger lager.Logger, host string, spec BandwidthSpec) (*BandwidthExperimentResult, error)
+
 type BandwidthExperiment struct {
 	Peers         peer.List
 	Logger        lager.Logger
 	CheckInterval time.Duration
+	Gate          schedule.Gate
 	Client        scienceClient
-	PayloadSize   int64
+	Alerts        alert.Board
+	Budget        budget.Budget
+	Limiter       budget.Bucket
+	Direction     string
+	Streams       int
 
-	ReportAvgBandwidth func(float64)
-}
+	// Sizing picks between sending PayloadSize bytes, streaming for
+	// Duration, or doubling from PayloadSize up to MaxPayloadSize until
+	// the throughput settles down.
+	Sizing         string
+	PayloadSize    int64
+	MaxPayloadSize int64
+	Duration       time.Duration
 
-func (b *BandwidthExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
-	rand.Seed(time.Now().UnixNano())
-	nextInterval, _ := time.ParseDuration(fmt.Sprintf("%ds", rand.Intn(5)))
-	close(ready)
+	// PayloadKinds are tested one after the other against the same target,
+	// so that their results can be compared.  Encoding, when set, applies
+	// to all of them.
+	PayloadKinds []string
+	Encoding     string
 
-	for {
-		select {
-		case <-signals:
-			return nil
-		case <-time.After(nextInterval):
-			b.run()
-		}
+	// RawClient, when set, repeats every test over the raw TCP data plane
+	RawClient scienceClient
 
-		jitter := (rand.Float64() + 0.5) * b.CheckInterval.Seconds() / 2
-		nextInterval = time.Duration(jitter) * time.Second
-		b.Logger.Debug("next-interval", lager.Data{"seconds": nextInterval.Seconds()})
-	}
+	// HTTP2Client, when set, repeats the random payload tests over HTTP/2.
+	// Parallel streams then share one connection, so head-of-line blocking
+	// shows up against the HTTP/1.1 results.
+	HTTP2Client scienceClient
+
+	// Lessor, when set, reserves each target for the length of a run.  A
+	// target busy with another node is passed over for the next.
+	Lessor   leaseClient
+	LeaseTTL time.Duration
+
+	// Targets are taken least recently measured first, one per run.
+	// CoveragePeriod, when set, is how long a peer may go unmeasured before
+	// an alert, and each run measures as many peers as it takes to get
+	// round them all in that time.
+	CoveragePeriod time.Duration
+
+	ReportResult   func(target string, result *BandwidthExperimentResult)
+	ReportCoverage func(overdue int, oldestSeconds float64)
+
+	latestLock sync.Mutex
+	latest     map[string][]*BandwidthExperimentResult
+
+	// measured holds when each peer was last measured, or first seen
+	measured map[string]time.Time
+}
+
+func (b *BandwidthExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	return runJittered(b.Logger, b.CheckInterval, b.Gate, signals, ready, b.run)
 }
 
 func (b *BandwidthExperiment) run() {
@@ -58,16 +184,450 @@ func (b *BandwidthExperiment) run() {
 	if len(candidates) < 1 {
 		return
 	}
+	defer b.checkCoverage(logger, candidates)
 
-	target := candidates[rand.Intn(len(candidates))].Host
-	logger = logger.WithData(lager.Data{"target": target})
+	wanted, measured := b.targetsPerRun(len(candidates)), 0
+	for _, target := range b.byLastMeasured(candidates) {
+		targetLogger := logger.WithData(lager.Data{"target": target})
+		results, err := b.leased(targetLogger, target, func() []*BandwidthExperimentResult {
+			return b.runTarget(targetLogger, target, 0)
+		})
+		if err == nil {
+			if anyResult(results) {
+				if measured++; measured == wanted {
+					return
+				}
+			}
+			continue
+		}
+		if err == ErrBusy {
+			targetLogger.Debug("busy")
+		} else {
+			targetLogger.Error("acquire-lease", err)
+		}
+	}
+	if measured == 0 {
+		logger.Info("no-target-available")
+	} else {
+		logger.Info("fewer-targets-than-wanted", lager.Data{"measured": measured, "wanted": wanted})
+	}
+}
+
+// targetsPerRun is how many of peers each run must measure for all of
+// them to be measured within CoveragePeriod, given that runJittered runs
+// every CheckInterval/2 on average
+func (b *BandwidthExperiment) targetsPerRun(peers int) int {
+	if b.CoveragePeriod <= 0 || b.CheckInterval <= 0 {
+		return 1
+	}
+	runs := int(b.CoveragePeriod / (b.CheckInterval / 2))
+	if runs < 1 {
+		runs = 1
+	}
+	return (peers + runs - 1) / runs
+}
+
+// Trigger runs the whole experiment against one target on demand
+func (b *BandwidthExperiment) Trigger(logger lager.Logger, spec TriggerSpec) (*TriggerResult, error) {
+	return spec.trigger(logger.Session("bandwidth-experiment"), b.Peers, func(logger lager.Logger, target string) (interface{}, error) {
+		denied := b.Budget.Usage().Denied[budgetBandwidth]
+		results, err := b.leased(logger, target, func() []*BandwidthExperimentResult {
+			return b.runTarget(logger, target, spec.PayloadSize)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if anyResult(results) {
+			return results, nil
+		}
+		if b.Budget.Usage().Denied[budgetBandwidth] > denied {
+			return nil, ErrOverBudget
+		}
+		return nil, ErrNoResults
+	})
+}
+
+// leased calls fn while holding a lease on target, when there is a Lessor
+func (b *BandwidthExperiment) leased(logger lager.Logger, target string, fn func() []*BandwidthExperimentResult) ([]*BandwidthExperimentResult, error) {
+	var results []*BandwidthExperimentResult
+	err := withLease(logger, b.Lessor, b.LeaseTTL, target, func() { results = fn() })
+	return results, err
+}
+
+// anyResult reports whether any of the tests came back
+func anyResult(results []*BandwidthExperimentResult) bool {
+	for _, r := range results {
+		if r != nil {
+			return true
+		}
+	}
+	return false
+}
 
-	result, err := b.Client.TestBandwidth(logger, target, b.PayloadSize)
+// byLastMeasured orders the candidates least recently measured first, and
+// otherwise at random, so that every peer gets its turn
+func (b *BandwidthExperiment) byLastMeasured(candidates []peer.Glimpse) []string {
+	hosts := make([]string, len(candidates))
+	for i, c := range candidates {
+		hosts[i] = c.Host
+	}
+	rand.Shuffle(len(hosts), func(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] })
+
+	b.latestLock.Lock()
+	defer b.latestLock.Unlock()
+	if b.measured == nil {
+		b.measured = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for _, host := range hosts {
+		if _, ok := b.measured[host]; !ok {
+			b.measured[host] = now
+		}
+	}
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return b.measured[hosts[i]].Before(b.measured[hosts[j]])
+	})
+	return hosts
+}
+
+// checkCoverage alerts on every peer that has gone unmeasured for longer
+// than CoveragePeriod, and forgets peers that have gone
+func (b *BandwidthExperiment) checkCoverage(logger lager.Logger, candidates []peer.Glimpse) {
+	current := make(map[string]bool)
+	for _, c := range candidates {
+		current[c.Host] = true
+	}
+
+	b.latestLock.Lock()
+	defer b.latestLock.Unlock()
+
+	now := time.Now()
+	overdue, oldest := 0, 0.0
+	for host, since := range b.measured {
+		if !current[host] {
+			delete(b.measured, host)
+			b.Alerts.Clear(logger, AlertCoverage, host)
+			continue
+		}
+		if b.CoveragePeriod == 0 {
+			continue
+		}
+
+		age := now.Sub(since)
+		oldest = math.Max(oldest, age.Seconds())
+		if age > b.CoveragePeriod {
+			overdue++
+			b.Alerts.Raise(logger, AlertCoverage, host, fmt.Sprintf("not measured for %s", age.Round(time.Second)))
+		} else {
+			b.Alerts.Clear(logger, AlertCoverage, host)
+		}
+	}
+	if b.CoveragePeriod != 0 {
+		b.ReportCoverage(overdue, oldest)
+	}
+}
+
+// runTarget makes every configured test against target, with payloadSize
+// overriding PayloadSize when set
+func (b *BandwidthExperiment) runTarget(logger lager.Logger, target string, payloadSize int64) []*BandwidthExperimentResult {
+	kinds := b.PayloadKinds
+	if len(kinds) == 0 {
+		kinds = []string{PayloadRandom}
+	}
+
+	var results []*BandwidthExperimentResult
+	for _, kind := range kinds {
+		base := BandwidthSpec{Kind: kind, Encoding: b.Encoding, PayloadSize: payloadSize}
+		results = append(results, b.runDirections(logger.WithData(lager.Data{"kind": kind}), target, b.Client, base)...)
+	}
+	if b.RawClient != nil {
+		results = append(results, b.runDirections(logger.Session("raw"), target, b.RawClient, BandwidthSpec{PayloadSize: payloadSize})...)
+	}
+	if b.Encoding == "" {
+		b.checkCompression(logger, target, results)
+	}
+	if b.HTTP2Client != nil {
+		base := BandwidthSpec{Kind: PayloadRandom, Encoding: b.Encoding, PayloadSize: payloadSize}
+		results = append(results, b.runDirections(logger.Session("http2"), target, b.HTTP2Client, base)...)
+	}
+
+	b.latestLock.Lock()
+	defer b.latestLock.Unlock()
+	if b.latest == nil {
+		b.latest = make(map[string][]*BandwidthExperimentResult)
+	}
+	b.latest[target] = results
+	for _, r := range results {
+		if r != nil {
+			if b.measured == nil {
+				b.measured = make(map[string]time.Time)
+			}
+			b.measured[target] = time.Now()
+			break
+		}
+	}
+	return results
+}
+
+// checkCompression compares each payload kind over HTTP with the random
+// payload sent in the same direction
+func (b *BandwidthExperiment) checkCompression(logger lager.Logger, target string, results []*BandwidthExperimentResult) {
+	baselines := make(map[string]*BandwidthExperimentResult)
+	for _, r := range results {
+		if r != nil && r.Transport == TransportHTTP && r.Kind == PayloadRandom {
+			baselines[r.Direction] = r
+		}
+	}
+
+	for _, r := range results {
+		if r == nil || r.Transport != TransportHTTP || r.Kind == PayloadRandom {
+			continue
+		}
+		baseline := baselines[r.Direction]
+		if baseline == nil || baseline.AvgBandwidth == 0 {
+			continue
+		}
+		r.RelativeBandwidth = r.AvgBandwidth / baseline.AvgBandwidth
+
+		if r.Kind != PayloadCompressible {
+			continue
+		}
+		subject := fmt.Sprintf("%s/%s", r.Direction, target)
+		if r.RelativeBandwidth > compressionSuspicion {
+			b.Alerts.Raise(logger, AlertCompression, subject, fmt.Sprintf(
+				"compressible payload %.1fx faster than random", r.RelativeBandwidth))
+		} else {
+			b.Alerts.Clear(logger, AlertCompression, subject)
+		}
+	}
+}
+
+func (b *BandwidthExperiment) runDirections(logger lager.Logger, target string, client scienceClient, base BandwidthSpec) []*BandwidthExperimentResult {
+	switch b.Direction {
+	case DirectionDownload:
+		return []*BandwidthExperimentResult{b.measure(logger, target, client.TestDownload, false, base)}
+	case DirectionBidirectional:
+		results := make([]*BandwidthExperimentResult, 2)
+		wg := sync.WaitGroup{}
+		for i, test := range []bandwidthTest{client.TestBandwidth, client.TestDownload} {
+			wg.Add(1)
+			go func(i int, test bandwidthTest) {
+				defer wg.Done()
+				results[i] = b.measure(logger, target, test, true, base)
+			}(i, test)
+		}
+		wg.Wait()
+		return results
+	default:
+		return []*BandwidthExperimentResult{b.measure(logger, target, client.TestBandwidth, false, base)}
+	}
+}
+
+// Latest returns the results of the most recent test against each target.
+// A failed test leaves a nil result.
+func (b *BandwidthExperiment) Latest() map[string][]*BandwidthExperimentResult {
+	b.latestLock.Lock()
+	defer b.latestLock.Unlock()
+
+	ret := make(map[string][]*BandwidthExperimentResult)
+	for k, v := range b.latest {
+		ret[k] = v
+	}
+	return ret
+}
+
+// measure sizes a test according to b.Sizing, filling in base.  A payload
+// size already in base is used instead of PayloadSize.
+func (b *BandwidthExperiment) measure(logger lager.Logger, target string, test bandwidthTest, bidirectional bool, base BandwidthSpec) *BandwidthExperimentResult {
+	if base.PayloadSize == 0 {
+		base.PayloadSize = b.PayloadSize
+	}
+	test = b.charged(test)
+
+	var result *BandwidthExperimentResult
+	var err error
+	switch b.Sizing {
+	case SizingDuration:
+		base.Duration = b.Duration
+		result, err = b.runStreams(logger, target, test, base)
+	case SizingAdaptive:
+		result, err = b.runAdaptive(logger, target, test, base)
+	default:
+		result, err = b.runStreams(logger, target, test, base)
+	}
+	if err == ErrOverBudget {
+		logger.Info("skipped-over-budget")
+		return nil
+	}
+	if err == ErrBusy {
+		logger.Info("busy")
+		return nil
+	}
 	if err != nil {
 		logger.Error("test-bandwidth", err)
-		return
+		return nil
+	}
+	result.Bidirectional = bidirectional
+
+	// only the HTTP transport verifies payloads, so only it can clear the alert
+	subject := fmt.Sprintf("%s/%s", result.Direction, target)
+	if result.Corrupt {
+		logger.Error("payload-corrupt", nil, lager.Data{"result": result})
+		b.Alerts.Raise(logger, AlertPayloadCorruption, subject, fmt.Sprintf(
+			"%d corrupt blocks, first at offset %d",
+			result.CorruptBlocks, result.FirstBadOffset))
+	} else if result.Transport == TransportHTTP {
+		b.Alerts.Clear(logger, AlertPayloadCorruption, subject)
+	}
+
+	b.ReportResult(target, result)
+	logger.Debug("done", lager.Data{"transport": result.Transport, "direction": result.Direction, "avg-bandwidth": result.AvgBandwidth})
+	return result
+}
+
+// estimate is how many bytes one stream of a test will send, as far as can
+// be told beforehand.  A test that runs for a duration is guessed at from
+// the fastest recent result, or zero before there is one.
+func (b *BandwidthExperiment) estimate(spec BandwidthSpec) int64 {
+	if spec.Duration == 0 {
+		return spec.PayloadSize
+	}
+
+	fastest := 0.0
+	for _, results := range b.Latest() {
+		for _, r := range results {
+			if r != nil && r.AvgBandwidth > fastest {
+				fastest = r.AvgBandwidth
+			}
+		}
+	}
+	streams := 1.0
+	if b.Streams > 1 {
+		streams = float64(b.Streams)
+	}
+	return int64(fastest * spec.Duration.Seconds() / streams)
+}
+
+// charged asks the budget before every test, so that each step of an
+// adaptive sweep is checked, and counts what the test sent against both
+// the budget and the limiter.  A test that failed part way is charged what
+// it was sized to send, since that is as much as it can have sent; one the
+// target turned away sent nothing.
+func (b *BandwidthExperiment) charged(test bandwidthTest) bandwidthTest {
+	return func(logger lager.Logger, host string, spec BandwidthSpec) (*BandwidthExperimentResult, error) {
+		estimate := b.estimate(spec)
+		if !b.Budget.Allow(logger, budgetBandwidth, estimate) {
+			return nil, ErrOverBudget
+		}
+		result, err := test(logger, host, spec)
+		sent := estimate
+		switch {
+		case result != nil:
+			sent = result.wireBytes()
+		case err == ErrBusy:
+			sent = 0
+		}
+		b.Budget.Spend(budgetBandwidth, sent)
+		b.Limiter.Take(sent)
+		return result, err
+	}
+}
+
+// wireBytes is what crossed the network, which is less than NumBytes when
+// the payload was compressed
+func (r *BandwidthExperimentResult) wireBytes() int64 {
+	if r.WireBytes > 0 {
+		return r.WireBytes
+	}
+	return r.NumBytes
+}
+
+// runAdaptive doubles the payload size until two successive tests agree on
+// the throughput, and returns the last of them with the whole curve attached.
+func (b *BandwidthExperiment) runAdaptive(logger lager.Logger, target string, test bandwidthTest, base BandwidthSpec) (*BandwidthExperimentResult, error) {
+	var curve []RampPoint
+	var result *BandwidthExperimentResult
+
+	start := base.PayloadSize
+	for size := start; size <= b.MaxPayloadSize; size *= 2 {
+		previous := result
+
+		var err error
+		base.PayloadSize = size
+		result, err = b.runStreams(logger, target, test, base)
+		if err != nil {
+			return nil, err
+		}
+		curve = append(curve, RampPoint{
+			Seconds:   result.DurationSeconds,
+			NumBytes:  result.NumBytes,
+			Bandwidth: result.AvgBandwidth,
+		})
+
+		if previous != nil && math.Abs(result.AvgBandwidth-previous.AvgBandwidth) <= adaptiveTolerance*previous.AvgBandwidth {
+			break
+		}
+	}
+	if result == nil {
+		return nil, fmt.Errorf("payload size %d exceeds maximum %d", start, b.MaxPayloadSize)
+	}
+
+	logger.Debug("adaptive", lager.Data{"curve": curve})
+	result.RampUp = curve
+	return result, nil
+}
+
+// runStreams runs b.Streams copies of test against target at once.  With a
+// single stream the result is returned as is, otherwise the streams are
+// combined into an aggregate over the wall time of the whole test.
+func (b *BandwidthExperiment) runStreams(logger lager.Logger, target string, test bandwidthTest, spec BandwidthSpec) (*BandwidthExperimentResult, error) {
+	// waiting here rather than inside test keeps the wait out of the
+	// timings of all the streams
+	b.Limiter.Wait()
+	if b.Streams <= 1 {
+		return test(logger, target, spec)
+	}
+
+	results := make([]*BandwidthExperimentResult, b.Streams)
+	errs := make([]error, b.Streams)
+	spec.Streams = b.Streams
+
+	startTime := time.Now()
+	wg := sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = test(logger.WithData(lager.Data{"stream": i}), target, spec)
+		}(i)
+	}
+	wg.Wait()
+	wallSeconds := time.Since(startTime).Seconds()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	aggregate := &BandwidthExperimentResult{
+		Transport:       results[0].Transport,
+		Protocol:        results[0].Protocol,
+		Direction:       results[0].Direction,
+		Kind:            results[0].Kind,
+		Encoding:        results[0].Encoding,
+		DurationSeconds: wallSeconds,
+	}
+	perStream := make([]float64, 0, len(results))
+	for _, r := range results {
+		aggregate.NumBytes += r.NumBytes
+		aggregate.WireBytes += r.WireBytes
+		aggregate.Integrity.Merge(r.Integrity)
+		perStream = append(perStream, r.AvgBandwidth)
 	}
+	aggregate.AvgBandwidth = float64(aggregate.NumBytes) / wallSeconds
 
-	b.ReportAvgBandwidth(result.AvgBandwidth)
-	logger.Debug("done", lager.Data{"avg-bandwidth": result.AvgBandwidth})
+	summary := SummarizeStreams(perStream)
+	aggregate.Streams = &summary
+	return aggregate, nil
 }
@@ -0,0 +1,215 @@
+package science
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	IdleReset   = "reset"
+	IdleClosed  = "closed"
+	IdleTimeout = "timeout"
+	IdleError   = "error"
+)
+
+// IdleConn is a long-lived connection that carries nothing but pings
+type IdleConn interface {
+	Ping(timeout time.Duration) error
+	Close() error
+}
+
+type idleClient interface {
+	OpenIdle(logger lager.Logger, host string) (IdleConn, error)
+}
+
+// IdleResult is what one long-lived connection found out.  The idle timeout
+// along the path lies between LongestIdle, the longest gap after which a
+// ping still worked, and FailedIdle, the gap after which one did not.  With
+// no Failure the connection outlasted the whole ladder of gaps.  Gaps are in
+// seconds.
+type IdleResult struct {
+	Time        time.Time `json:"time"`
+	LongestIdle float64   `json:"longest_idle"`
+	FailedIdle  float64   `json:"failed_idle,omitempty"`
+	Failure     string    `json:"failure,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// IdleTimeoutExperiment holds a connection to every peer and leaves it idle
+// for MinGap, then twice that, and so on up to MaxGap, pinging after each
+// gap.  When a ping fails it reports, reconnects and starts again.
+type IdleTimeoutExperiment struct {
+	Peers         peer.List
+	Logger        lager.Logger
+	CheckInterval time.Duration
+	Gate          schedule.Gate
+	Client        idleClient
+	MinGap        time.Duration
+	MaxGap        time.Duration
+	PingTimeout   time.Duration
+
+	ReportResult func(target string, result *IdleResult)
+
+	latestLock sync.Mutex
+	latest     map[string]*IdleResult
+}
+
+// Run starts a holder for each new peer every CheckInterval, and stops the
+// holders of peers that have gone, or of every peer while the gate is closed
+func (e *IdleTimeoutExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := e.Logger.Session("idle-experiment")
+	close(ready)
+
+	holders := make(map[string]chan struct{})
+	defer func() {
+		for _, stop := range holders {
+			close(stop)
+		}
+	}()
+
+	ticker := time.NewTicker(e.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		// a closed gate leaves current empty, which stops every holder
+		current := make(map[string]bool)
+		if e.Gate == nil || e.Gate.Open() {
+			for _, candidate := range e.Peers.Snapshot(logger) {
+				current[candidate.Host] = true
+				if _, ok := holders[candidate.Host]; !ok {
+					stop := make(chan struct{})
+					holders[candidate.Host] = stop
+					go e.hold(logger.WithData(lager.Data{"target": candidate.Host}), candidate.Host, stop)
+				}
+			}
+		}
+		for host, stop := range holders {
+			if !current[host] {
+				close(stop)
+				delete(holders, host)
+			}
+		}
+
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *IdleTimeoutExperiment) hold(logger lager.Logger, target string, stop <-chan struct{}) {
+	for {
+		result, err := e.climb(logger, target, stop)
+		switch {
+		case err != nil:
+			logger.Error("open-idle", err)
+		case result == nil:
+			return
+		default:
+			if result.Failure != "" {
+				logger.Info("idle-failure", lager.Data{"result": result})
+			} else {
+				logger.Debug("idle-ladder-complete", lager.Data{"result": result})
+			}
+			e.ReportResult(target, result)
+			e.record(target, result)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(e.MinGap):
+		}
+	}
+}
+
+// climb runs the ladder of gaps over one connection.  It returns nil if
+// stopped first.
+func (e *IdleTimeoutExperiment) climb(logger lager.Logger, target string, stop <-chan struct{}) (*IdleResult, error) {
+	conn, err := e.Client.OpenIdle(logger, target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result := &IdleResult{}
+	fail := func(gap time.Duration, err error) *IdleResult {
+		result.Time = time.Now()
+		result.FailedIdle = gap.Seconds()
+		result.Failure, result.Error = classifyIdleFailure(err), err.Error()
+		return result
+	}
+
+	if err := conn.Ping(e.PingTimeout); err != nil {
+		return fail(0, err), nil
+	}
+
+	for gap := e.MinGap; ; gap *= 2 {
+		if gap > e.MaxGap {
+			gap = e.MaxGap
+		}
+
+		select {
+		case <-stop:
+			return nil, nil
+		case <-time.After(gap):
+		}
+
+		if err := conn.Ping(e.PingTimeout); err != nil {
+			return fail(gap, err), nil
+		}
+		result.LongestIdle = gap.Seconds()
+		logger.Debug("idle-gap-survived", lager.Data{"seconds": gap.Seconds()})
+
+		if gap == e.MaxGap {
+			result.Time = time.Now()
+			return result, nil
+		}
+	}
+}
+
+func classifyIdleFailure(err error) string {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return IdleTimeout
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return IdleReset
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return IdleClosed
+	}
+	return IdleError
+}
+
+func (e *IdleTimeoutExperiment) record(target string, result *IdleResult) {
+	e.latestLock.Lock()
+	defer e.latestLock.Unlock()
+
+	if e.latest == nil {
+		e.latest = make(map[string]*IdleResult)
+	}
+	e.latest[target] = result
+}
+
+// Latest returns the most recent result for each peer
+func (e *IdleTimeoutExperiment) Latest() map[string]*IdleResult {
+	e.latestLock.Lock()
+	defer e.latestLock.Unlock()
+
+	ret := make(map[string]*IdleResult)
+	for k, v := range e.latest {
+		ret[k] = v
+	}
+	return ret
+}
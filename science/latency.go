@@ -0,0 +1,114 @@
+package science
+
+import (
+	"os"
+	"time"
+
+	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	ConnectionKeepAlive = "keepalive"
+	ConnectionFresh     = "fresh"
+)
+
+type latencyClient interface {
+	Ping(logger lager.Logger, host string, fresh bool) (time.Duration, error)
+}
+
+type LatencyExperiment struct {
+	Peers         peer.List
+	Logger        lager.Logger
+	CheckInterval time.Duration
+	Gate          schedule.Gate
+	Client        latencyClient
+	PingCount     int
+
+	// HTTP2Client, when set, repeats every burst over HTTP/2
+	HTTP2Client latencyClient
+
+	ReportLatency func(target, protocol, connection string, summary LatencySummary)
+}
+
+func (l *LatencyExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	return runJittered(l.Logger, l.CheckInterval, l.Gate, signals, ready, l.run)
+}
+
+func (l *LatencyExperiment) run() {
+	logger := l.Logger.Session("latency-experiment")
+	defer logger.Debug("done")
+
+	for _, candidate := range l.Peers.Snapshot(logger) {
+		l.runTarget(logger.WithData(lager.Data{"target": candidate.Host}), candidate.Host)
+	}
+}
+
+// LatencyBurst is one burst of pings, as returned by Trigger.  Summary is
+// nil when the burst failed.
+type LatencyBurst struct {
+	Protocol   string          `json:"protocol"`
+	Connection string          `json:"connection"`
+	Summary    *LatencySummary `json:"summary,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Trigger pings one target on demand, and fails when no burst got through
+func (l *LatencyExperiment) Trigger(logger lager.Logger, spec TriggerSpec) (*TriggerResult, error) {
+	return spec.trigger(logger.Session("latency-experiment"), l.Peers, func(logger lager.Logger, target string) (interface{}, error) {
+		bursts := l.runTarget(logger, target)
+		for _, b := range bursts {
+			if b.Summary != nil {
+				return bursts, nil
+			}
+		}
+		return nil, ErrNoResults
+	})
+}
+
+// runTarget sends a burst of pings to target for each protocol and kind
+// of connection
+func (l *LatencyExperiment) runTarget(logger lager.Logger, target string) []LatencyBurst {
+	clients := map[string]latencyClient{ProtocolHTTP1: l.Client}
+	protocols := []string{ProtocolHTTP1}
+	if l.HTTP2Client != nil {
+		clients[ProtocolHTTP2] = l.HTTP2Client
+		protocols = append(protocols, ProtocolHTTP2)
+	}
+
+	var bursts []LatencyBurst
+	for _, protocol := range protocols {
+		for _, connection := range []string{ConnectionKeepAlive, ConnectionFresh} {
+			b := LatencyBurst{Protocol: protocol, Connection: connection}
+			data := lager.Data{"protocol": protocol, "connection": connection}
+			summary, err := l.burst(logger, clients[protocol], target, connection == ConnectionFresh)
+			if err != nil {
+				logger.Error("ping", err, data)
+				b.Error = err.Error()
+				bursts = append(bursts, b)
+				continue
+			}
+
+			l.ReportLatency(target, protocol, connection, summary)
+			data["summary"] = summary
+			logger.Debug("burst", data)
+			b.Summary = &summary
+			bursts = append(bursts, b)
+		}
+	}
+	return bursts
+}
+
+func (l *LatencyExperiment) burst(logger lager.Logger, client latencyClient, target string, fresh bool) (LatencySummary, error) {
+	samples := make([]float64, 0, l.PingCount)
+	for i := 0; i < l.PingCount; i++ {
+		rtt, err := client.Ping(logger, target, fresh)
+		if err != nil {
+			return LatencySummary{}, err
+		}
+		samples = append(samples, rtt.Seconds())
+	}
+	return Summarize(samples), nil
+}
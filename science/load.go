@@ -0,0 +1,188 @@
+package science
+
+import (
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rosenhouse/reflex/budget"
+	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// maxErrorKinds bounds the distinct error messages kept in a LoadResult
+const maxErrorKinds = 10
+
+// LoadResult describes one load test against a peer's echo endpoint.
+// Latency covers successful requests only.  Missed counts the ticks at
+// which every worker was still busy, so no request went out; a high count
+// means Rate is out of reach at this Concurrency.  Throughput is successful
+// requests per second.
+type LoadResult struct {
+	Target          string         `json:"target"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	TargetRate      float64        `json:"target_rate"`
+	Requests        int            `json:"requests"`
+	Successes       int            `json:"successes"`
+	Failures        int            `json:"failures"`
+	Missed          int            `json:"missed"`
+	ErrorRate       float64        `json:"error_rate"`
+	Throughput      float64        `json:"throughput"`
+	BytesReceived   int64          `json:"bytes_received"`
+	Latency         LatencySummary `json:"latency"`
+	Errors          map[string]int `json:"errors,omitempty"`
+}
+
+type loadClient interface {
+	LoadEcho(logger lager.Logger, host string, requestSize, responseSize int, timeout time.Duration) (int64, error)
+}
+
+// LoadExperiment sends Rate requests a second for Duration to a random peer,
+// from at most Concurrency requests at once.  Requests are started on a
+// fixed schedule whether or not earlier ones have finished, so a slow peer
+// shows up as latency and missed ticks rather than as a lower rate.
+type LoadExperiment struct {
+	Peers         peer.List
+	Logger        lager.Logger
+	CheckInterval time.Duration
+	Gate          schedule.Gate
+	Client        loadClient
+	Budget        budget.Budget
+	Limiter       budget.Bucket
+	Rate          float64
+	Concurrency   int
+	Duration      time.Duration
+	RequestSize   int
+	ResponseSize  int
+	Timeout       time.Duration
+
+	ReportResult func(result *LoadResult)
+}
+
+func (l *LoadExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	return runJittered(l.Logger, l.CheckInterval, l.Gate, signals, ready, l.run)
+}
+
+func (l *LoadExperiment) run() {
+	logger := l.Logger.Session("load-experiment")
+	defer logger.Debug("done")
+
+	candidates := l.Peers.Snapshot(logger)
+	if len(candidates) < 1 {
+		return
+	}
+	target := candidates[rand.Intn(len(candidates))].Host
+	l.runTarget(logger.WithData(lager.Data{"target": target}), target)
+}
+
+// Trigger load tests one target on demand
+func (l *LoadExperiment) Trigger(logger lager.Logger, spec TriggerSpec) (*TriggerResult, error) {
+	return spec.trigger(logger.Session("load-experiment"), l.Peers, func(logger lager.Logger, target string) (interface{}, error) {
+		result := l.runTarget(logger, target)
+		if result == nil {
+			return nil, ErrOverBudget
+		}
+		return result, nil
+	})
+}
+
+// runTarget load tests target, unless that would go over budget.  Like a
+// bandwidth test, the run as a whole waits on the limiter rather than being
+// throttled, which would only hold it below Rate.
+func (l *LoadExperiment) runTarget(logger lager.Logger, target string) *LoadResult {
+	requests := int64(l.Rate * l.Duration.Seconds())
+	if !l.Budget.Allow(logger, budgetLoad, requests*int64(l.RequestSize+l.ResponseSize)) {
+		logger.Info("skipped-over-budget")
+		return nil
+	}
+
+	l.Limiter.Wait()
+	logger.Debug("starting", lager.Data{"rate": l.Rate, "concurrency": l.Concurrency})
+	result := l.attack(logger, target)
+	sent := int64(result.Requests)*int64(l.RequestSize) + result.BytesReceived
+	l.Budget.Spend(budgetLoad, sent)
+	l.Limiter.Take(sent)
+	logger.Info("complete", lager.Data{"result": result})
+	l.ReportResult(result)
+	return result
+}
+
+type loadSample struct {
+	latency  time.Duration
+	received int64
+	err      error
+}
+
+func (l *LoadExperiment) attack(logger lager.Logger, target string) *LoadResult {
+	result := &LoadResult{Target: target, TargetRate: l.Rate}
+
+	work := make(chan struct{})
+	samples := make(chan loadSample, l.Concurrency)
+	workers := sync.WaitGroup{}
+	for i := 0; i < l.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for range work {
+				start := time.Now()
+				n, err := l.Client.LoadEcho(logger, target, l.RequestSize, l.ResponseSize, l.Timeout)
+				samples <- loadSample{latency: time.Since(start), received: n, err: err}
+			}
+		}()
+	}
+
+	collected := make(chan []float64)
+	go func() {
+		var latencies []float64
+		for s := range samples {
+			result.BytesReceived += s.received
+			if s.err != nil {
+				result.Failures++
+				if result.Errors == nil {
+					result.Errors = make(map[string]int)
+				}
+				if _, ok := result.Errors[s.err.Error()]; ok || len(result.Errors) < maxErrorKinds {
+					result.Errors[s.err.Error()]++
+				}
+				continue
+			}
+			result.Successes++
+			latencies = append(latencies, s.latency.Seconds())
+		}
+		collected <- latencies
+	}()
+
+	startTime := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / l.Rate))
+	deadline := time.After(l.Duration)
+attack:
+	for {
+		select {
+		case <-deadline:
+			break attack
+		case <-ticker.C:
+			select {
+			case work <- struct{}{}:
+				result.Requests++
+			default:
+				result.Missed++
+			}
+		}
+	}
+	ticker.Stop()
+	close(work)
+	workers.Wait()
+	close(samples)
+	latencies := <-collected
+
+	result.DurationSeconds = time.Since(startTime).Seconds()
+	result.Latency = Summarize(latencies)
+	result.Throughput = float64(result.Successes) / result.DurationSeconds
+	if result.Requests > 0 {
+		result.ErrorRate = float64(result.Failures) / float64(result.Requests)
+	}
+	return result
+}
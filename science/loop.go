@@ -0,0 +1,38 @@
+package science
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// runJittered calls fn after a short random delay, and then again at random
+// intervals centred on half of checkInterval, until it receives a signal.
+// When gate is set, fn is only called while the gate is open.
+func runJittered(logger lager.Logger, checkInterval time.Duration, gate schedule.Gate, signals <-chan os.Signal, ready chan<- struct{}, fn func()) error {
+	rand.Seed(time.Now().UnixNano())
+	nextInterval, _ := time.ParseDuration(fmt.Sprintf("%ds", rand.Intn(5)))
+	close(ready)
+
+	for {
+		select {
+		case <-signals:
+			return nil
+		case <-time.After(nextInterval):
+			if gate == nil || gate.Open() {
+				fn()
+			} else {
+				logger.Debug("gate-closed")
+			}
+		}
+
+		jitter := (rand.Float64() + 0.5) * checkInterval.Seconds() / 2
+		nextInterval = time.Duration(jitter) * time.Second
+		logger.Debug("next-interval", lager.Data{"seconds": nextInterval.Seconds()})
+	}
+}
@@ -0,0 +1,74 @@
+package science
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rosenhouse/reflex/alert"
+	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const AlertPathMTU = "path-mtu-low"
+
+// MTUResult compares the largest IP packet that reached a peer with DF set
+// against the MTU of the local interface the route leaves by.  The two
+// differ when something along the path, such as overlay encapsulation,
+// eats into the packet.
+type MTUResult struct {
+	InterfaceMTU int  `json:"interface_mtu"`
+	PathMTU      int  `json:"path_mtu"`
+	Mismatch     bool `json:"mismatch"`
+	Probes       int  `json:"probes"`
+}
+
+type mtuClient interface {
+	DiscoverPathMTU(logger lager.Logger, host string) (*MTUResult, error)
+}
+
+type MTUExperiment struct {
+	Peers         peer.List
+	Logger        lager.Logger
+	CheckInterval time.Duration
+	Gate          schedule.Gate
+	Client        mtuClient
+	Alerts        alert.Board
+
+	// ExpectedMTU, when set, is the smallest path MTU that is not alerted on
+	ExpectedMTU int
+
+	ReportResult func(target string, result *MTUResult)
+}
+
+func (m *MTUExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	return runJittered(m.Logger, m.CheckInterval, m.Gate, signals, ready, m.run)
+}
+
+func (m *MTUExperiment) run() {
+	logger := m.Logger.Session("mtu-experiment")
+	defer logger.Debug("done")
+
+	for _, candidate := range m.Peers.Snapshot(logger) {
+		targetLogger := logger.WithData(lager.Data{"target": candidate.Host})
+		result, err := m.Client.DiscoverPathMTU(targetLogger, candidate.Host)
+		if err != nil {
+			targetLogger.Error("discover-path-mtu", err)
+			continue
+		}
+
+		if result.Mismatch {
+			targetLogger.Info("mtu-mismatch", lager.Data{"result": result})
+		}
+		if m.ExpectedMTU > 0 && result.PathMTU < m.ExpectedMTU {
+			m.Alerts.Raise(targetLogger, AlertPathMTU, candidate.Host, fmt.Sprintf(
+				"path MTU %d is below the expected %d", result.PathMTU, m.ExpectedMTU))
+		} else {
+			m.Alerts.Clear(targetLogger, AlertPathMTU, candidate.Host)
+		}
+
+		m.ReportResult(candidate.Host, result)
+	}
+}
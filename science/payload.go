@@ -0,0 +1,392 @@
+package science
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	PayloadRandom       = "random"
+	PayloadPartial      = "partial"
+	PayloadCompressible = "compressible"
+)
+
+const EncodingGzip = "gzip"
+
+// BandwidthSpec says how much data one bandwidth test moves: a fixed number
+// of bytes, or as much as fits into Duration when that is set.
+// Seed and Kind pick the payload, see NewPayload.  Encoding, when set,
+// compresses the payload on the wire.  Streams, when more than one, says
+// the test is one of that many run at once, which only the client can add
+// up.
+type BandwidthSpec struct {
+	PayloadSize int64
+	Duration    time.Duration
+	Seed        uint64
+	Kind        string
+	Encoding    string
+	Streams     int
+}
+
+// Query encodes the spec for a bandwidth request
+func (s BandwidthSpec) Query() url.Values {
+	q := url.Values{}
+	q.Set("seed", strconv.FormatUint(s.Seed, 10))
+	if s.Kind != "" {
+		q.Set("kind", s.Kind)
+	}
+	if s.Encoding != "" {
+		q.Set("encoding", s.Encoding)
+	}
+	if s.Streams > 1 {
+		q.Set("streams", strconv.Itoa(s.Streams))
+	}
+	if s.Duration > 0 {
+		q.Set("duration", s.Duration.String())
+	} else {
+		q.Set("bytes", strconv.FormatInt(s.PayloadSize, 10))
+	}
+	return q
+}
+
+// ParseBandwidthSpec is the inverse of BandwidthSpec.Query
+func ParseBandwidthSpec(q url.Values) (BandwidthSpec, error) {
+	spec := BandwidthSpec{}
+	if seed := q.Get("seed"); seed != "" {
+		var err error
+		spec.Seed, err = strconv.ParseUint(seed, 10, 64)
+		if err != nil {
+			return spec, fmt.Errorf("seed must be an unsigned integer")
+		}
+	}
+
+	switch spec.Kind = q.Get("kind"); spec.Kind {
+	case "", PayloadRandom, PayloadPartial, PayloadCompressible:
+	default:
+		return spec, fmt.Errorf("unknown payload kind %q", spec.Kind)
+	}
+
+	switch spec.Encoding = q.Get("encoding"); spec.Encoding {
+	case "", EncodingGzip:
+	default:
+		return spec, fmt.Errorf("unknown encoding %q", spec.Encoding)
+	}
+
+	if streams := q.Get("streams"); streams != "" {
+		var err error
+		spec.Streams, err = strconv.Atoi(streams)
+		if err != nil || spec.Streams < 1 {
+			return spec, fmt.Errorf("streams must be a positive integer")
+		}
+	}
+
+	if d := q.Get("duration"); d != "" {
+		var err error
+		spec.Duration, err = time.ParseDuration(d)
+		if err != nil || spec.Duration <= 0 {
+			return spec, fmt.Errorf("duration must be positive")
+		}
+		return spec, nil
+	}
+
+	var err error
+	spec.PayloadSize, err = strconv.ParseInt(q.Get("bytes"), 10, 64)
+	if err != nil || spec.PayloadSize < 0 {
+		return spec, fmt.Errorf("bytes must be a non-negative integer")
+	}
+	return spec, nil
+}
+
+// BandwidthLimits caps the tests a server will serve for its peers.  A zero
+// field means no cap.
+type BandwidthLimits struct {
+	MaxPayloadSize int64
+	MaxDuration    time.Duration
+}
+
+// Check rejects a spec that asks for more than the limits allow
+func (l BandwidthLimits) Check(spec BandwidthSpec) error {
+	if l.MaxDuration > 0 && spec.Duration > l.MaxDuration {
+		return fmt.Errorf("duration must be at most %s", l.MaxDuration)
+	}
+	if l.MaxPayloadSize > 0 && spec.PayloadSize > l.MaxPayloadSize {
+		return fmt.Errorf("bytes must be at most %d", l.MaxPayloadSize)
+	}
+	return nil
+}
+
+// Limit cuts source down to the size of the test
+func (s BandwidthSpec) Limit(source io.Reader) io.Reader {
+	if s.Duration > 0 {
+		return &deadlineReader{source: source, duration: s.Duration}
+	}
+	return io.LimitReader(source, s.PayloadSize)
+}
+
+// Compress gzips r on the fly, for a request body
+func Compress(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz, _ := gzip.NewWriterLevel(pw, gzip.BestSpeed)
+		_, err := io.Copy(gz, r)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// CountingReader counts the bytes read through it, e.g. compressed bytes
+// off the wire
+type CountingReader struct {
+	io.Reader
+	N int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// CountingWriter counts the bytes written through it
+type CountingWriter struct {
+	io.Writer
+	N int64
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// deadlineReader returns EOF once duration has passed since its first Read
+type deadlineReader struct {
+	source   io.Reader
+	duration time.Duration
+	deadline time.Time
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.deadline.IsZero() {
+		r.deadline = time.Now().Add(r.duration)
+	}
+	if time.Now().After(r.deadline) {
+		return 0, io.EOF
+	}
+	return r.source.Read(p)
+}
+
+// PayloadBlockSize is the unit in which payloads are generated and checked
+const PayloadBlockSize = 64 << 10
+
+// compressiblePeriod is the length of the pattern that compressible
+// payloads repeat, well inside the window of any common compressor
+const compressiblePeriod = 64
+
+// NewPayload returns an endless stream of pseudo-random bytes determined by
+// seed.  Each block is generated from the seed and its own index alone, so
+// the receiver can regenerate and check the stream as it arrives without
+// either side hashing it.  The bytes are not suitable for anything secret.
+//
+// A random payload does not compress at all.  A compressible one repeats a
+// short pattern through each block, and a partial one does so only in the
+// second half of each block.
+func NewPayload(seed uint64, kind string) io.Reader {
+	return &payloadReader{seed: seed, kind: kind, block: make([]byte, PayloadBlockSize)}
+}
+
+type payloadReader struct {
+	seed   uint64
+	kind   string
+	offset int64
+	block  []byte
+}
+
+func (r *payloadReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		i := r.offset % PayloadBlockSize
+		if i == 0 {
+			fillBlock(r.block, r.seed, r.offset/PayloadBlockSize, r.kind)
+		}
+		c := copy(p[n:], r.block[i:])
+		n += c
+		r.offset += int64(c)
+	}
+	return n, nil
+}
+
+func fillBlock(block []byte, seed uint64, index int64, kind string) {
+	switch kind {
+	case PayloadCompressible:
+		fillRandom(block[:compressiblePeriod], seed, index)
+		repeat(block, compressiblePeriod)
+	case PayloadPartial:
+		half := block[len(block)/2:]
+		fillRandom(block[:len(block)/2+compressiblePeriod], seed, index)
+		repeat(half, compressiblePeriod)
+	default:
+		fillRandom(block, seed, index)
+	}
+}
+
+// repeat copies the first period bytes of b over the rest of it
+func repeat(b []byte, period int) {
+	for filled := period; filled < len(b); filled *= 2 {
+		copy(b[filled:], b[:filled])
+	}
+}
+
+// fillRandom runs splitmix64 from a state derived from the seed and index
+func fillRandom(block []byte, seed uint64, index int64) {
+	state := seed ^ uint64(index)*0x9e3779b97f4a7c15
+	for i := 0; i < len(block); i += 8 {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		binary.LittleEndian.PutUint64(block[i:], z^(z>>31))
+	}
+}
+
+// MaxCorruptOffsets bounds how many corrupt block offsets are kept, so
+// that a badly broken path cannot blow up the size of a result
+const MaxCorruptOffsets = 64
+
+// Integrity describes how a received payload differed from the one
+// generated from its seed.  Offsets are where corrupt blocks start.
+type Integrity struct {
+	Corrupt        bool    `json:"corrupt"`
+	CorruptBlocks  int     `json:"corrupt_blocks"`
+	FirstBadOffset int64   `json:"first_bad_offset,omitempty"`
+	CorruptOffsets []int64 `json:"corrupt_offsets,omitempty"`
+}
+
+func (i *Integrity) addCorruptBlock(offset int64) {
+	if !i.Corrupt {
+		i.Corrupt = true
+		i.FirstBadOffset = offset
+	}
+	i.CorruptBlocks++
+	if len(i.CorruptOffsets) < MaxCorruptOffsets {
+		i.CorruptOffsets = append(i.CorruptOffsets, offset)
+	}
+}
+
+// Merge folds the integrity of another stream into this one
+func (i *Integrity) Merge(other Integrity) {
+	if other.Corrupt && !i.Corrupt {
+		i.Corrupt = true
+		i.FirstBadOffset = other.FirstBadOffset
+	}
+	i.CorruptBlocks += other.CorruptBlocks
+	for _, offset := range other.CorruptOffsets {
+		if len(i.CorruptOffsets) < MaxCorruptOffsets {
+			i.CorruptOffsets = append(i.CorruptOffsets, offset)
+		}
+	}
+}
+
+// PayloadVerifier compares what is written through it against the payload
+// for its seed, one block at a time.
+type PayloadVerifier struct {
+	Integrity
+
+	expected     io.Reader
+	buffer       []byte
+	offset       int64
+	lastBadBlock int64
+}
+
+func NewPayloadVerifier(seed uint64, kind string) *PayloadVerifier {
+	return &PayloadVerifier{
+		expected:     NewPayload(seed, kind),
+		buffer:       make([]byte, PayloadBlockSize),
+		lastBadBlock: -1,
+	}
+}
+
+func (v *PayloadVerifier) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		// never compare across a block boundary, so a mismatch names one block
+		size := PayloadBlockSize - int(v.offset%PayloadBlockSize)
+		if size > len(p)-n {
+			size = len(p) - n
+		}
+
+		expected := v.buffer[:size]
+		v.expected.Read(expected)
+
+		// a block may arrive over several writes, but only counts once
+		block := v.offset / PayloadBlockSize
+		if block != v.lastBadBlock && !bytes.Equal(expected, p[n:n+size]) {
+			v.lastBadBlock = block
+			v.addCorruptBlock(block * PayloadBlockSize)
+		}
+
+		n += size
+		v.offset += int64(size)
+	}
+	return len(p), nil
+}
+
+// RampInterval is how often a RampRecorder samples throughput
+const RampInterval = 100 * time.Millisecond
+
+// RampPoint is one point on a throughput curve.  Within a single test it
+// covers the interval ending Seconds after the first byte, with NumBytes
+// counted so far.  For adaptive sizing it is a whole test of NumBytes.
+type RampPoint struct {
+	Seconds   float64 `json:"seconds"`
+	NumBytes  int64   `json:"num_bytes"`
+	Bandwidth float64 `json:"bandwidth"`
+}
+
+// RampRecorder counts the bytes written through it and records a RampPoint
+// every RampInterval, so that TCP slow start shows up in the results.
+type RampRecorder struct {
+	start      time.Time
+	lastSample time.Time
+	numBytes   int64
+	lastBytes  int64
+	points     []RampPoint
+}
+
+func (r *RampRecorder) Write(p []byte) (int, error) {
+	now := time.Now()
+	if r.start.IsZero() {
+		r.start, r.lastSample = now, now
+	}
+
+	r.numBytes += int64(len(p))
+	if now.Sub(r.lastSample) >= RampInterval {
+		r.sample(now)
+	}
+	return len(p), nil
+}
+
+func (r *RampRecorder) sample(now time.Time) {
+	r.points = append(r.points, RampPoint{
+		Seconds:   now.Sub(r.start).Seconds(),
+		NumBytes:  r.numBytes,
+		Bandwidth: float64(r.numBytes-r.lastBytes) / now.Sub(r.lastSample).Seconds(),
+	})
+	r.lastSample, r.lastBytes = now, r.numBytes
+}
+
+// Points closes off the final, partial interval and returns the curve
+func (r *RampRecorder) Points() []RampPoint {
+	if now := time.Now(); r.numBytes > r.lastBytes && now.After(r.lastSample) {
+		r.sample(now)
+	}
+	return r.points
+}
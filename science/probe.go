@@ -0,0 +1,179 @@
+package science
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	ProbeHTTP = "http"
+	ProbeTCP  = "tcp"
+	ProbeDNS  = "dns"
+)
+
+// ProbeTarget is something outside the mesh that every node should be able
+// to reach, such as a database or an internal API.  Name labels its metrics.
+type ProbeTarget struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Address string `json:"address"`
+}
+
+// ParseProbeTargets reads a comma separated list of targets, each an
+// http:// or https:// URL, tcp://host:port or dns://name, optionally
+// preceded by "name=".  Without a name, the scheme, host and any port are
+// used, such as tcp-db-5432.  Names must be unique.
+func ParseProbeTargets(s string) ([]ProbeTarget, error) {
+	var targets []ProbeTarget
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		t := ProbeTarget{}
+		if i := strings.Index(entry, "="); i >= 0 && !strings.Contains(entry[:i], "/") {
+			t.Name, entry = entry[:i], entry[i+1:]
+		}
+
+		u, err := url.Parse(entry)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "http", "https":
+			t.Kind, t.Address = ProbeHTTP, entry
+		case "tcp":
+			if _, _, err := net.SplitHostPort(u.Host); err != nil {
+				return nil, fmt.Errorf("%s: %s", entry, err)
+			}
+			t.Kind, t.Address = ProbeTCP, u.Host
+		case "dns":
+			t.Kind, t.Address = ProbeDNS, u.Host
+		default:
+			return nil, fmt.Errorf("%s: unknown probe scheme %q", entry, u.Scheme)
+		}
+		if t.Name == "" {
+			t.Name = u.Scheme + "-" + u.Hostname()
+			if port := u.Port(); port != "" {
+				t.Name += "-" + port
+			}
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("%s: probe name %q is already taken, give it another with name=", entry, t.Name)
+		}
+		names[t.Name] = true
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// ProbeResult is one probe of a target.  Duration is in seconds.
+type ProbeResult struct {
+	ProbeTarget
+	Time      time.Time `json:"time"`
+	Success   bool      `json:"success"`
+	Duration  float64   `json:"duration"`
+	Status    int       `json:"status,omitempty"`
+	Addresses []string  `json:"addresses,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type probeClient interface {
+	ProbeHTTP(logger lager.Logger, url string, timeout time.Duration) (int, error)
+	Connect(logger lager.Logger, address string, timeout time.Duration) error
+	Resolve(logger lager.Logger, name string, timeout time.Duration) ([]string, error)
+}
+
+// ProbeExperiment probes every target at once, each time round
+type ProbeExperiment struct {
+	Logger        lager.Logger
+	CheckInterval time.Duration
+	Gate          schedule.Gate
+	Client        probeClient
+	Targets       []ProbeTarget
+	Timeout       time.Duration
+
+	ReportResult func(result *ProbeResult)
+
+	latestLock sync.Mutex
+	latest     map[string]*ProbeResult
+}
+
+func (p *ProbeExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	return runJittered(p.Logger, p.CheckInterval, p.Gate, signals, ready, p.run)
+}
+
+func (p *ProbeExperiment) run() {
+	logger := p.Logger.Session("probe-experiment")
+	defer logger.Debug("done")
+
+	results := make([]*ProbeResult, len(p.Targets))
+	wg := sync.WaitGroup{}
+	for i := range p.Targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = p.probe(logger.WithData(lager.Data{"probe": p.Targets[i].Name}), p.Targets[i])
+		}(i)
+	}
+	wg.Wait()
+
+	p.latestLock.Lock()
+	defer p.latestLock.Unlock()
+	if p.latest == nil {
+		p.latest = make(map[string]*ProbeResult)
+	}
+	for _, r := range results {
+		p.ReportResult(r)
+		p.latest[r.Name] = r
+	}
+}
+
+func (p *ProbeExperiment) probe(logger lager.Logger, target ProbeTarget) *ProbeResult {
+	result := &ProbeResult{ProbeTarget: target, Time: time.Now()}
+
+	var err error
+	switch target.Kind {
+	case ProbeHTTP:
+		result.Status, err = p.Client.ProbeHTTP(logger, target.Address, p.Timeout)
+		if err == nil && result.Status >= 400 {
+			err = fmt.Errorf("unexpected status %d", result.Status)
+		}
+	case ProbeTCP:
+		err = p.Client.Connect(logger, target.Address, p.Timeout)
+	case ProbeDNS:
+		result.Addresses, err = p.Client.Resolve(logger, target.Address, p.Timeout)
+	}
+	result.Duration = time.Since(result.Time).Seconds()
+
+	if err != nil {
+		result.Error = err.Error()
+		logger.Error("probe-failed", err)
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+// Latest returns the most recent result for each target, by name
+func (p *ProbeExperiment) Latest() map[string]*ProbeResult {
+	p.latestLock.Lock()
+	defer p.latestLock.Unlock()
+
+	ret := make(map[string]*ProbeResult)
+	for k, v := range p.latest {
+		ret[k] = v
+	}
+	return ret
+}
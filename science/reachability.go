@@ -0,0 +1,283 @@
+package science
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rosenhouse/reflex/alert"
+	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	ReachAllowed = "allowed"
+	ReachBlocked = "blocked"
+	ReachTimeout = "timeout"
+)
+
+const AlertReachability = "reachability-policy"
+
+// ReachabilityTarget is a set of ports to try on every peer or, when Group
+// is set, only on the peers inside one of its CIDRs.
+type ReachabilityTarget struct {
+	Group string   `json:"group,omitempty"`
+	CIDRs []string `json:"cidrs,omitempty"`
+	Ports []int    `json:"ports"`
+
+	nets []*net.IPNet
+}
+
+func (t *ReachabilityTarget) contains(host string) bool {
+	if t.Group == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	for _, n := range t.nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseReachabilityTargets accepts either a comma separated list of ports to
+// try on every peer, or a JSON list of ReachabilityTarget
+func ParseReachabilityTargets(s string) ([]ReachabilityTarget, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	var targets []ReachabilityTarget
+	if strings.HasPrefix(s, "[") {
+		if err := json.Unmarshal([]byte(s), &targets); err != nil {
+			return nil, err
+		}
+	} else {
+		t := ReachabilityTarget{}
+		for _, p := range strings.Split(s, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil {
+				return nil, fmt.Errorf("bad port %q", p)
+			}
+			t.Ports = append(t.Ports, port)
+		}
+		targets = append(targets, t)
+	}
+
+	for i := range targets {
+		t := &targets[i]
+		if t.Group != "" && len(t.CIDRs) == 0 {
+			return nil, fmt.Errorf("group %q has no cidrs", t.Group)
+		}
+		for _, c := range t.CIDRs {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return nil, err
+			}
+			t.nets = append(t.nets, n)
+		}
+		for _, port := range t.Ports {
+			if port < 1 || port > 65535 {
+				return nil, fmt.Errorf("port %d out of range", port)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// ReachabilityRule is one entry in an expected policy.  An empty From (a
+// CIDR holding the node doing the connecting), Group or Port matches
+// anything, and the first matching rule wins.  Expect is allowed or blocked,
+// and a timeout counts as blocked.
+type ReachabilityRule struct {
+	From   string `json:"from,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Expect string `json:"expect"`
+
+	from *net.IPNet
+}
+
+func (r *ReachabilityRule) matches(source net.IP, group string, port int) bool {
+	if r.from != nil && (source == nil || !r.from.Contains(source)) {
+		return false
+	}
+	if r.Group != "" && r.Group != group {
+		return false
+	}
+	return r.Port == 0 || r.Port == port
+}
+
+// ParseReachabilityPolicy reads an expected policy, a JSON list of
+// ReachabilityRule
+func ParseReachabilityPolicy(data []byte) ([]ReachabilityRule, error) {
+	var rules []ReachabilityRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		r := &rules[i]
+		switch r.Expect {
+		case ReachAllowed, ReachBlocked:
+		default:
+			return nil, fmt.Errorf("rule %d: expect must be %q or %q", i, ReachAllowed, ReachBlocked)
+		}
+		if r.From != "" {
+			var err error
+			if _, r.from, err = net.ParseCIDR(r.From); err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// ReachabilityCell is the outcome of one connect.  Expected and Pass are
+// only set when a policy rule covers it.
+type ReachabilityCell struct {
+	Host     string `json:"host"`
+	Group    string `json:"group,omitempty"`
+	Port     int    `json:"port"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Pass     *bool  `json:"pass,omitempty"`
+}
+
+// ReachabilityMatrix is one row per peer and port, as seen from Source
+type ReachabilityMatrix struct {
+	Source   string             `json:"source"`
+	Time     time.Time          `json:"time"`
+	Cells    []ReachabilityCell `json:"cells"`
+	Failures int                `json:"failures"`
+	Pass     bool               `json:"pass"`
+}
+
+type reachabilityClient interface {
+	Connect(logger lager.Logger, address string, timeout time.Duration) error
+}
+
+type ReachabilityExperiment struct {
+	Peers         peer.List
+	Logger        lager.Logger
+	CheckInterval time.Duration
+	Gate          schedule.Gate
+	Client        reachabilityClient
+	Alerts        alert.Board
+	Source        string
+	Timeout       time.Duration
+	Workers       int
+	Targets       []ReachabilityTarget
+	Policy        []ReachabilityRule
+
+	ReportMatrix func(matrix *ReachabilityMatrix)
+
+	latestLock sync.Mutex
+	latest     *ReachabilityMatrix
+}
+
+func (e *ReachabilityExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	return runJittered(e.Logger, e.CheckInterval, e.Gate, signals, ready, e.run)
+}
+
+func (e *ReachabilityExperiment) run() {
+	logger := e.Logger.Session("reachability-experiment")
+	defer logger.Debug("done")
+
+	var cells []ReachabilityCell
+	for _, candidate := range e.Peers.Snapshot(logger) {
+		for i := range e.Targets {
+			t := &e.Targets[i]
+			if !t.contains(candidate.Host) {
+				continue
+			}
+			for _, port := range t.Ports {
+				cells = append(cells, ReachabilityCell{Host: candidate.Host, Group: t.Group, Port: port})
+			}
+		}
+	}
+
+	// a fixed pool of workers, since peers times ports can be large and
+	// every blocked cell holds its connect open until Timeout
+	work := make(chan *ReachabilityCell)
+	wg := sync.WaitGroup{}
+	for i := 0; i < e.Workers && i < len(cells); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				e.connect(logger, c)
+			}
+		}()
+	}
+	for i := range cells {
+		work <- &cells[i]
+	}
+	close(work)
+	wg.Wait()
+
+	matrix := &ReachabilityMatrix{Source: e.Source, Time: time.Now(), Cells: cells, Pass: true}
+	failing := make(map[string]bool)
+	for i := range cells {
+		c := &cells[i]
+		if c.Pass != nil && !*c.Pass {
+			matrix.Failures++
+			matrix.Pass = false
+			subject := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+			failing[subject] = true
+			e.Alerts.Raise(logger, AlertReachability, subject, fmt.Sprintf(
+				"expected %s but connect from %s was %s", c.Expected, e.Source, c.Result))
+		}
+	}
+	for _, a := range e.Alerts.Snapshot() {
+		if a.Name == AlertReachability && !failing[a.Subject] {
+			e.Alerts.Clear(logger, AlertReachability, a.Subject)
+		}
+	}
+
+	logger.Info("matrix", lager.Data{"cells": len(cells), "failures": matrix.Failures})
+	e.ReportMatrix(matrix)
+
+	e.latestLock.Lock()
+	defer e.latestLock.Unlock()
+	e.latest = matrix
+}
+
+func (e *ReachabilityExperiment) connect(logger lager.Logger, c *ReachabilityCell) {
+	address := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	err := e.Client.Connect(logger, address, e.Timeout)
+	switch netErr, ok := err.(net.Error); {
+	case err == nil:
+		c.Result = ReachAllowed
+	case ok && netErr.Timeout():
+		c.Result = ReachTimeout
+	default:
+		c.Result = ReachBlocked
+		c.Error = err.Error()
+	}
+
+	source := net.ParseIP(e.Source)
+	for i := range e.Policy {
+		if r := &e.Policy[i]; r.matches(source, c.Group, c.Port) {
+			pass := (c.Result == ReachAllowed) == (r.Expect == ReachAllowed)
+			c.Expected, c.Pass = r.Expect, &pass
+			break
+		}
+	}
+}
+
+// Latest returns the most recent matrix, or nil before the first run
+func (e *ReachabilityExperiment) Latest() *ReachabilityMatrix {
+	e.latestLock.Lock()
+	defer e.latestLock.Unlock()
+	return e.latest
+}
@@ -0,0 +1,141 @@
+package science
+
+import (
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/rosenhouse/reflex/budget"
+	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// RoutingResult puts the same measurements through the platform router and
+// straight to one instance side by side.  Overhead is routed less direct
+// median latency, in seconds, and BandwidthRatio is routed over direct
+// upload bandwidth.
+type RoutingResult struct {
+	Target          string         `json:"target"`
+	Direct          LatencySummary `json:"direct"`
+	Routed          LatencySummary `json:"routed"`
+	Overhead        float64        `json:"overhead"`
+	DirectBandwidth float64        `json:"direct_bandwidth"`
+	RoutedBandwidth float64        `json:"routed_bandwidth"`
+	BandwidthRatio  float64        `json:"bandwidth_ratio"`
+}
+
+type routingClient interface {
+	Ping(logger lager.Logger, host string, fresh bool) (time.Duration, error)
+	PingRoute(logger lager.Logger, route string) (time.Duration, error)
+	TestBandwidth(logger lager.Logger, host string, spec BandwidthSpec) (*BandwidthExperimentResult, error)
+	TestRouteBandwidth(logger lager.Logger, route, host string, spec BandwidthSpec) (*BandwidthExperimentResult, error)
+}
+
+type RoutingExperiment struct {
+	Peers         peer.List
+	Logger        lager.Logger
+	CheckInterval time.Duration
+	Gate          schedule.Gate
+	Client        routingClient
+	Budget        budget.Budget
+	Limiter       budget.Bucket
+	Lessor        leaseClient
+	LeaseTTL      time.Duration
+	Route         string
+	PingCount     int
+	PayloadSize   int64
+
+	ReportResult func(result *RoutingResult)
+}
+
+func (r *RoutingExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	return runJittered(r.Logger, r.CheckInterval, r.Gate, signals, ready, r.run)
+}
+
+func (r *RoutingExperiment) run() {
+	logger := r.Logger.Session("routing-experiment").WithData(lager.Data{"route": r.Route})
+	defer logger.Debug("done")
+
+	candidates := r.Peers.Snapshot(logger)
+	if len(candidates) < 1 {
+		return
+	}
+	target := candidates[rand.Intn(len(candidates))].Host
+	logger = logger.WithData(lager.Data{"target": target})
+
+	// a comparison without bandwidth is no comparison, so skip the lot
+	if !r.Budget.Allow(logger, budgetRouting, 2*r.PayloadSize) {
+		return
+	}
+
+	result := &RoutingResult{Target: target}
+	var err error
+	result.Direct, err = r.burst(func() (time.Duration, error) { return r.Client.Ping(logger, target, false) })
+	if err != nil {
+		logger.Error("ping-direct", err)
+		return
+	}
+	result.Routed, err = r.burst(func() (time.Duration, error) { return r.Client.PingRoute(logger, r.Route) })
+	if err != nil {
+		logger.Error("ping-routed", err)
+		return
+	}
+	result.Overhead = result.Routed.Median - result.Direct.Median
+
+	// the target is leased like any bandwidth test, and the routed test
+	// carries that lease, but it lands wherever the router sends it, so
+	// that one may still find its instance busy
+	var direct, routed *BandwidthExperimentResult
+	var testErr error
+	err = withLease(logger, r.Lessor, r.LeaseTTL, target, func() {
+		spec := BandwidthSpec{PayloadSize: r.PayloadSize}
+		r.Limiter.Wait()
+		if direct, testErr = r.Client.TestBandwidth(logger, target, spec); testErr != nil {
+			return
+		}
+		r.spend(direct)
+		r.Limiter.Wait()
+		if routed, testErr = r.Client.TestRouteBandwidth(logger, r.Route, target, spec); testErr != nil {
+			return
+		}
+		r.spend(routed)
+	})
+	if err == nil {
+		err = testErr
+	}
+	if err == ErrBusy {
+		logger.Info("busy")
+		return
+	}
+	if err != nil {
+		logger.Error("test-bandwidth", err)
+		return
+	}
+	result.DirectBandwidth, result.RoutedBandwidth = direct.AvgBandwidth, routed.AvgBandwidth
+	if result.DirectBandwidth > 0 {
+		result.BandwidthRatio = result.RoutedBandwidth / result.DirectBandwidth
+	}
+
+	logger.Info("comparison", lager.Data{"result": result})
+	r.ReportResult(result)
+}
+
+// spend counts a bandwidth test against both the budget and the limiter
+func (r *RoutingExperiment) spend(result *BandwidthExperimentResult) {
+	r.Budget.Spend(budgetRouting, result.wireBytes())
+	r.Limiter.Take(result.wireBytes())
+}
+
+func (r *RoutingExperiment) burst(ping func() (time.Duration, error)) (LatencySummary, error) {
+	samples := make([]float64, 0, r.PingCount)
+	for i := 0; i < r.PingCount; i++ {
+		rtt, err := ping()
+		if err != nil {
+			return LatencySummary{}, err
+		}
+		samples = append(samples, rtt.Seconds())
+	}
+	return Summarize(samples), nil
+}
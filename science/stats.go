@@ -0,0 +1,92 @@
+package science
+
+import (
+	"math"
+	"sort"
+)
+
+// LatencySummary describes a burst of round-trip samples, in seconds.
+type LatencySummary struct {
+	Count  int     `json:"count"`
+	Min    float64 `json:"min"`
+	Median float64 `json:"median"`
+	P95    float64 `json:"p95"`
+	P99    float64 `json:"p99"`
+	Max    float64 `json:"max"`
+	Jitter float64 `json:"jitter"`
+}
+
+// Summarize computes a LatencySummary from samples given in the order they
+// were taken.  Jitter is the mean absolute difference between consecutive
+// samples, so it depends on that order.
+func Summarize(samples []float64) LatencySummary {
+	summary := LatencySummary{Count: len(samples)}
+	if len(samples) == 0 {
+		return summary
+	}
+
+	var totalDelta float64
+	for i := 1; i < len(samples); i++ {
+		totalDelta += math.Abs(samples[i] - samples[i-1])
+	}
+	if len(samples) > 1 {
+		summary.Jitter = totalDelta / float64(len(samples)-1)
+	}
+
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+
+	summary.Min = sorted[0]
+	summary.Max = sorted[len(sorted)-1]
+	summary.Median = percentile(sorted, 0.5)
+	summary.P95 = percentile(sorted, 0.95)
+	summary.P99 = percentile(sorted, 0.99)
+	return summary
+}
+
+// percentile uses the nearest-rank method on an already sorted slice
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// StreamSummary describes how the throughput of a parallel test was shared
+// between its streams, in bytes per second.
+type StreamSummary struct {
+	Count    int     `json:"count"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+
+	// Fairness is Jain's index: 1 when every stream got the same share,
+	// falling towards 1/Count as one stream takes everything.
+	Fairness float64 `json:"fairness"`
+}
+
+func SummarizeStreams(bandwidths []float64) StreamSummary {
+	summary := StreamSummary{Count: len(bandwidths)}
+	if len(bandwidths) == 0 {
+		return summary
+	}
+
+	summary.Min, summary.Max = bandwidths[0], bandwidths[0]
+	var sum, sumOfSquares float64
+	for _, b := range bandwidths {
+		summary.Min = math.Min(summary.Min, b)
+		summary.Max = math.Max(summary.Max, b)
+		sum += b
+		sumOfSquares += b * b
+	}
+
+	n := float64(len(bandwidths))
+	summary.Mean = sum / n
+	summary.Variance = math.Max(0, sumOfSquares/n-summary.Mean*summary.Mean)
+	if sumOfSquares > 0 {
+		summary.Fairness = sum * sum / (n * sumOfSquares)
+	}
+	return summary
+}
@@ -0,0 +1,56 @@
+package science
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/rosenhouse/reflex/peer"
+
+	"code.cloudfoundry.org/lager"
+)
+
+var (
+	ErrNoTarget   = errors.New("no peers to target")
+	ErrOverBudget = errors.New("over traffic budget")
+	ErrNoResults  = errors.New("every test failed")
+)
+
+// TriggerSpec asks for one run of an experiment now, whatever its schedule.
+// Target is a peer host, or empty for a random peer.  PayloadSize, where
+// the experiment sends a payload, overrides the configured size.  Count
+// repeats the run against the same target.
+type TriggerSpec struct {
+	Target      string `json:"target,omitempty"`
+	PayloadSize int64  `json:"payload_size,omitempty"`
+	Count       int    `json:"count"`
+}
+
+// TriggerResult holds what each of the runs found, in order.  Results are
+// reported as usual as well.
+type TriggerResult struct {
+	Target string        `json:"target"`
+	Runs   []interface{} `json:"runs"`
+}
+
+// trigger runs fn spec.Count times against the requested target
+func (spec TriggerSpec) trigger(logger lager.Logger, peers peer.List, fn func(logger lager.Logger, target string) (interface{}, error)) (*TriggerResult, error) {
+	target := spec.Target
+	if target == "" {
+		candidates := peers.Snapshot(logger)
+		if len(candidates) < 1 {
+			return nil, ErrNoTarget
+		}
+		target = candidates[rand.Intn(len(candidates))].Host
+	}
+	logger = logger.WithData(lager.Data{"target": target, "triggered": true})
+
+	result := &TriggerResult{Target: target}
+	for i := 0; i < spec.Count || i == 0; i++ {
+		run, err := fn(logger, target)
+		if err != nil {
+			return nil, err
+		}
+		result.Runs = append(result.Runs, run)
+	}
+	return result, nil
+}
@@ -0,0 +1,68 @@
+package science
+
+import (
+	"os"
+	"time"
+
+	"github.com/rosenhouse/reflex/peer"
+	"github.com/rosenhouse/reflex/schedule"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// UDPTrainResult describes one train of datagrams sent to a peer's UDP echo
+// service and echoed back.  Loss covers the whole round trip.  When the
+// server reported what it saw, the Forward fields describe the way there
+// and the Reverse fields the way back.  Jitter is in seconds.
+type UDPTrainResult struct {
+	Sent     int            `json:"sent"`
+	Received int            `json:"received"`
+	Loss     float64        `json:"loss"`
+	RTT      LatencySummary `json:"rtt"`
+
+	ServerReported    bool    `json:"server_reported"`
+	ServerReceived    int     `json:"server_received"`
+	ForwardLoss       float64 `json:"forward_loss"`
+	ForwardReordered  int     `json:"forward_reordered"`
+	ForwardDuplicates int     `json:"forward_duplicates"`
+	ForwardJitter     float64 `json:"forward_jitter"`
+	ReverseLoss       float64 `json:"reverse_loss"`
+	ReverseReordered  int     `json:"reverse_reordered"`
+	ReverseDuplicates int     `json:"reverse_duplicates"`
+	ReverseJitter     float64 `json:"reverse_jitter"`
+}
+
+type udpClient interface {
+	SendTrain(logger lager.Logger, host string) (*UDPTrainResult, error)
+}
+
+type UDPExperiment struct {
+	Peers         peer.List
+	Logger        lager.Logger
+	CheckInterval time.Duration
+	Gate          schedule.Gate
+	Client        udpClient
+
+	ReportResult func(target string, result *UDPTrainResult)
+}
+
+func (u *UDPExperiment) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	return runJittered(u.Logger, u.CheckInterval, u.Gate, signals, ready, u.run)
+}
+
+func (u *UDPExperiment) run() {
+	logger := u.Logger.Session("udp-experiment")
+	defer logger.Debug("done")
+
+	for _, candidate := range u.Peers.Snapshot(logger) {
+		targetLogger := logger.WithData(lager.Data{"target": candidate.Host})
+		result, err := u.Client.SendTrain(targetLogger, candidate.Host)
+		if err != nil {
+			targetLogger.Error("send-train", err)
+			continue
+		}
+
+		targetLogger.Info("train", lager.Data{"result": result})
+		u.ReportResult(candidate.Host, result)
+	}
+}
@@ -0,0 +1,69 @@
+// Package server runs the reflex HTTP API.  It stands in for ifrit's
+// http_server so that handlers can get at the connection behind a request,
+// see ConnFromContext.
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// shutdownTimeout is how long in-flight requests get to finish before
+// their connections are cut, since a bandwidth test can run for a while
+const shutdownTimeout = 10 * time.Second
+
+type connKey struct{}
+
+// ConnFromContext returns the connection a request arrived on, or nil
+func ConnFromContext(ctx context.Context) net.Conn {
+	conn, _ := ctx.Value(connKey{}).(net.Conn)
+	return conn
+}
+
+type Server struct {
+	Address string
+	Handler http.Handler
+}
+
+func (s *Server) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	listener, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+
+	// h2c alongside HTTP/1.1, so that clients can compare the two
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	server := &http.Server{
+		Handler:   s.Handler,
+		Protocols: protocols,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, conn)
+		},
+	}
+
+	serveErrs := make(chan error, 1)
+	go func() {
+		serveErrs <- server.Serve(listener)
+	}()
+
+	close(ready)
+
+	select {
+	case <-signals:
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+			return err
+		}
+		return nil
+	case err := <-serveErrs:
+		return err
+	}
+}
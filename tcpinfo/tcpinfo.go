@@ -0,0 +1,30 @@
+// Package tcpinfo reads the kernel's view of a TCP connection, so that a
+// bandwidth test can tell loss-limited throughput from latency-limited
+// throughput without a packet capture.
+package tcpinfo
+
+import (
+	"errors"
+	"net"
+)
+
+var ErrUnsupported = errors.New("tcp info is not supported on this platform")
+
+// Stats is a subset of Linux's struct tcp_info.  Times are in seconds and
+// rates in bytes per second.
+type Stats struct {
+	RTT              float64 `json:"rtt"`
+	RTTVar           float64 `json:"rtt_var"`
+	MinRTT           float64 `json:"min_rtt"`
+	TotalRetransmits uint32  `json:"total_retransmits"`
+	CongestionWindow uint32  `json:"cwnd"`
+	SendMSS          uint32  `json:"snd_mss"`
+	PacingRate       uint64  `json:"pacing_rate"`
+	DeliveryRate     uint64  `json:"delivery_rate"`
+}
+
+// Read returns the current statistics for conn, which must be a TCP
+// connection that exposes its file descriptor.
+func Read(conn net.Conn) (*Stats, error) {
+	return read(conn)
+}
@@ -0,0 +1,66 @@
+//go:build linux && !386
+// +build linux,!386
+
+package tcpinfo
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// rawInfo extends syscall.TCPInfo with the fields added to struct tcp_info
+// since Linux 3.15.  Older kernels fill in less and leave the rest zero.
+type rawInfo struct {
+	syscall.TCPInfo
+	PacingRate    uint64
+	MaxPacingRate uint64
+	BytesAcked    uint64
+	BytesReceived uint64
+	SegsOut       uint32
+	SegsIn        uint32
+	NotsentBytes  uint32
+	MinRTT        uint32
+	DataSegsIn    uint32
+	DataSegsOut   uint32
+	DeliveryRate  uint64
+}
+
+func read(conn net.Conn) (*Stats, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("%T does not expose a file descriptor", conn)
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var info rawInfo
+	size := uint32(unsafe.Sizeof(info))
+	var errno syscall.Errno
+	err = rawConn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+
+	const microsecond = 1e-6
+	return &Stats{
+		RTT:              float64(info.Rtt) * microsecond,
+		RTTVar:           float64(info.Rttvar) * microsecond,
+		MinRTT:           float64(info.MinRTT) * microsecond,
+		TotalRetransmits: info.Total_retrans,
+		CongestionWindow: info.Snd_cwnd,
+		SendMSS:          info.Snd_mss,
+		PacingRate:       info.PacingRate,
+		DeliveryRate:     info.DeliveryRate,
+	}, nil
+}
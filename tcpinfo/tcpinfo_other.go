@@ -0,0 +1,10 @@
+//go:build !linux || 386
+// +build !linux 386
+
+package tcpinfo
+
+import "net"
+
+func read(conn net.Conn) (*Stats, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,155 @@
+package udpecho
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/rosenhouse/reflex/science"
+)
+
+// reportAttempts is how many times the client asks for the server's view of
+// a train before making do with what the echoes carried
+const reportAttempts = 3
+
+type Client struct {
+	Port       int
+	Count      int
+	Interval   time.Duration
+	PacketSize int
+	Timeout    time.Duration
+}
+
+// train is the client's view of one train.  Only one goroutine touches it
+// at a time.
+type train struct {
+	id       uint64
+	reverse  *arrivals
+	rtts     []float64
+	server   packet
+	reported bool
+}
+
+// receive reads echoes until the read deadline passes or, if untilReport is
+// set, the server's report arrives
+func (t *train) receive(conn net.Conn, untilReport bool) error {
+	buffer := make([]byte, 64<<10)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil
+			}
+			return err
+		}
+		now := time.Now()
+
+		p, err := unmarshal(buffer[:n])
+		if err != nil || p.Train != t.id {
+			continue
+		}
+		if p.Received >= t.server.Received {
+			t.server = p
+		}
+
+		switch p.Kind {
+		case kindProbe:
+			if t.reverse.add(p.Seq, p.Echoed, now.UnixNano()) {
+				t.rtts = append(t.rtts, now.Sub(time.Unix(0, p.Sent)).Seconds())
+			}
+		case kindReport:
+			t.server, t.reported = p, true
+			if untilReport {
+				return nil
+			}
+		}
+	}
+}
+
+// SendTrain sends Count probes, one every Interval, then waits Timeout for
+// the last echoes and asks the server what it saw
+func (c *Client) SendTrain(logger lager.Logger, host string) (*science.UDPTrainResult, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(c.Port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	t := &train{id: rand.Uint64(), reverse: newArrivals()}
+	receiveErrs := make(chan error, 1)
+	go func() {
+		receiveErrs <- t.receive(conn, false)
+	}()
+
+	logger.Debug("sending-train", lager.Data{"count": c.Count, "interval": c.Interval.String()})
+	datagram := make([]byte, c.PacketSize)
+	ticker := time.NewTicker(c.Interval)
+	for seq := 0; seq < c.Count; seq++ {
+		if seq > 0 {
+			<-ticker.C
+		}
+		packet{Kind: kindProbe, Train: t.id, Seq: uint32(seq), Sent: time.Now().UnixNano()}.putHeader(datagram)
+		if _, err = conn.Write(datagram); err != nil {
+			break
+		}
+	}
+	ticker.Stop()
+
+	conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	if receiveErr := <-receiveErrs; err == nil {
+		err = receiveErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, MinPacketSize)
+	for attempt := 0; attempt < reportAttempts && !t.reported; attempt++ {
+		packet{Kind: kindReport, Train: t.id, Sent: time.Now().UnixNano()}.putHeader(request)
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(c.Timeout))
+		if err := t.receive(conn, true); err != nil {
+			return nil, err
+		}
+	}
+	if !t.reported {
+		logger.Info("no-report", lager.Data{"attempts": reportAttempts})
+	}
+
+	return t.result(c.Count), nil
+}
+
+func (t *train) result(sent int) *science.UDPTrainResult {
+	r := &science.UDPTrainResult{
+		Sent:              sent,
+		Received:          int(t.reverse.received),
+		RTT:               science.Summarize(t.rtts),
+		ReverseReordered:  int(t.reverse.reordered),
+		ReverseDuplicates: int(t.reverse.duplicates),
+		ReverseJitter:     t.reverse.jitter / float64(time.Second),
+	}
+	if sent > 0 {
+		r.Loss = 1 - float64(r.Received)/float64(sent)
+	}
+
+	if t.server.Kind == 0 {
+		return r
+	}
+	r.ServerReported = true
+	r.ServerReceived = int(t.server.Received)
+	r.ForwardReordered = int(t.server.Reordered)
+	r.ForwardDuplicates = int(t.server.Duplicates)
+	r.ForwardJitter = float64(t.server.Jitter) / float64(time.Second)
+	if sent > 0 {
+		r.ForwardLoss = 1 - float64(r.ServerReceived)/float64(sent)
+	}
+	if r.ServerReceived > 0 {
+		r.ReverseLoss = 1 - float64(r.Received)/float64(r.ServerReceived)
+	}
+	return r
+}
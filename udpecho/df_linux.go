@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package udpecho
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// DontFragmentSupported says whether path MTU probes can be sent here
+const DontFragmentSupported = true
+
+// setDontFragment sets DF on everything sent from conn.  IP_PMTUDISC_PROBE
+// also stops the kernel from applying the path MTU it has cached, so that
+// oversized probes go out and black holes show up as missing echoes.
+func setDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		level, option, value := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE
+		if conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+			level, option, value = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), level, option, value)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// isTooBig reports whether a send failed because the datagram would not fit
+// the local interface
+func isTooBig(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package udpecho
+
+import "net"
+
+// DontFragmentSupported says whether path MTU probes can be sent here
+const DontFragmentSupported = false
+
+func setDontFragment(conn *net.UDPConn) error {
+	return ErrDontFragmentUnsupported
+}
+
+func isTooBig(err error) bool {
+	return false
+}
@@ -0,0 +1,150 @@
+package udpecho
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/rosenhouse/reflex/science"
+)
+
+const (
+	// mtuAttempts is how often a probe size is tried before it is taken to
+	// be too big, so that ordinary loss does not shrink the answer
+	mtuAttempts = 2
+
+	// maxIPPacket is the most an IP length field can hold
+	maxIPPacket = 65535
+)
+
+// DiscoverPathMTU binary searches for the largest IP packet that reaches
+// host with DF set, between the smallest probe and the MTU of the local
+// interface that the route to host leaves by
+func (c *Client) DiscoverPathMTU(logger lager.Logger, host string) (*science.MTUResult, error) {
+	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(c.Port)))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := setDontFragment(conn); err != nil {
+		return nil, err
+	}
+
+	result := &science.MTUResult{}
+	result.InterfaceMTU, err = interfaceMTU(conn.LocalAddr().(*net.UDPAddr).IP)
+	if err != nil {
+		return nil, err
+	}
+
+	overhead := 8 + 20
+	if raddr.IP.To4() == nil {
+		overhead = 8 + 40
+	}
+
+	p := &mtuProber{conn: conn, id: rand.Uint64(), timeout: c.Timeout}
+	fits := func(mtu int) (bool, error) {
+		result.Probes++
+		return p.fits(mtu - overhead)
+	}
+
+	limit := result.InterfaceMTU
+	if limit > maxIPPacket {
+		limit = maxIPPacket
+	}
+	lo, hi := MinPacketSize+overhead, limit
+	if ok, err := fits(lo); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("no echo for a %d byte probe", lo)
+	}
+
+	if ok, err := fits(hi); err != nil {
+		return nil, err
+	} else if ok {
+		lo = hi
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		ok, err := fits(mid)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	result.PathMTU = lo
+	result.Mismatch = result.PathMTU < limit
+	logger.Debug("path-mtu", lager.Data{"result": result})
+	return result, nil
+}
+
+type mtuProber struct {
+	conn    *net.UDPConn
+	id      uint64
+	seq     uint32
+	timeout time.Duration
+}
+
+// fits reports whether a datagram of size bytes was echoed
+func (p *mtuProber) fits(size int) (bool, error) {
+	datagram := make([]byte, size)
+	buffer := make([]byte, MinPacketSize)
+	for attempt := 0; attempt < mtuAttempts; attempt++ {
+		p.seq++
+		packet{Kind: kindMTU, Train: p.id, Seq: p.seq, Sent: time.Now().UnixNano()}.putHeader(datagram)
+		if _, err := p.conn.Write(datagram); err != nil {
+			if isTooBig(err) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		p.conn.SetReadDeadline(time.Now().Add(p.timeout))
+		for {
+			n, err := p.conn.Read(buffer)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			} else if err != nil {
+				return false, err
+			}
+			echo, err := unmarshal(buffer[:n])
+			if err == nil && echo.Kind == kindMTU && echo.Train == p.id && echo.Seq == p.seq {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// interfaceMTU finds the MTU of the interface that holds ip
+func interfaceMTU(ip net.IP) (int, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return iface.MTU, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no interface has address %s", ip)
+}
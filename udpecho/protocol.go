@@ -0,0 +1,98 @@
+// Package udpecho is a UDP echo service for measuring what TCP hides: loss,
+// reordering, duplication and jitter.  The server echoes every probe it is
+// sent, stamped with what it has seen of the train so far, so the client can
+// tell the forward path from the reverse one.  It also acknowledges the
+// don't-fragment probes used to find the path MTU.
+package udpecho
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	kindProbe  byte = 'P'
+	kindReport byte = 'R'
+	kindMTU    byte = 'M'
+)
+
+var ErrDontFragmentUnsupported = errors.New("setting DF is not supported on this platform")
+
+// packet opens every datagram, in both directions.  The server overwrites
+// the fields from Echoed onwards and leaves any padding alone.
+type packet struct {
+	Kind  byte
+	Train uint64
+	Seq   uint32
+	Sent  int64
+
+	Echoed     int64
+	Received   uint32
+	Reordered  uint32
+	Duplicates uint32
+	Jitter     int64
+}
+
+// MinPacketSize is the smallest datagram that holds a header
+var MinPacketSize = binary.Size(packet{})
+
+// putHeader writes p over the start of datagram b
+func (p packet) putHeader(b []byte) {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, p)
+	copy(b, buf.Bytes())
+}
+
+func unmarshal(b []byte) (packet, error) {
+	p := packet{}
+	if len(b) < MinPacketSize {
+		return p, fmt.Errorf("short datagram of %d bytes", len(b))
+	}
+	err := binary.Read(bytes.NewReader(b[:MinPacketSize]), binary.BigEndian, &p)
+	return p, err
+}
+
+// arrivals tracks one direction of a train
+type arrivals struct {
+	seen        map[uint32]bool
+	maxSeq      uint32
+	received    uint32
+	reordered   uint32
+	duplicates  uint32
+	jitter      float64
+	lastTransit int64
+}
+
+func newArrivals() *arrivals {
+	return &arrivals{seen: make(map[uint32]bool)}
+}
+
+// add records seq, sent at sent on the sender's clock and received at
+// received on ours.  The clocks need not agree, since jitter only looks at
+// differences between transit times (RFC 3550, section 6.4.1).  Returns
+// false for a duplicate.
+func (a *arrivals) add(seq uint32, sent, received int64) bool {
+	if a.seen[seq] {
+		a.duplicates++
+		return false
+	}
+	a.seen[seq] = true
+
+	transit := received - sent
+	if a.received > 0 {
+		if seq < a.maxSeq {
+			a.reordered++
+		}
+		d := math.Abs(float64(transit - a.lastTransit))
+		a.jitter += (d - a.jitter) / 16
+	}
+	if seq > a.maxSeq {
+		a.maxSeq = seq
+	}
+	a.received++
+	a.lastTransit = transit
+	return true
+}
@@ -0,0 +1,149 @@
+package udpecho
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	// trainIdleTimeout is how long the server remembers a train it has
+	// stopped hearing from
+	trainIdleTimeout = time.Minute
+
+	// maxTrains bounds the trains remembered at once.  Datagrams of new
+	// trains beyond it go unanswered until old ones are forgotten.
+	maxTrains = 1024
+
+	// MaxTrainLength bounds the sequence numbers of a train, and with
+	// them how much the server remembers of each
+	MaxTrainLength = 10000
+)
+
+// Server echoes datagrams from sources inside AllowedCIDR
+type Server struct {
+	Logger      lager.Logger
+	Address     string
+	AllowedCIDR *net.IPNet
+}
+
+type trainState struct {
+	*arrivals
+	lastSeen time.Time
+}
+
+func (s *Server) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	conn, err := net.ListenPacket("udp", s.Address)
+	if err != nil {
+		return err
+	}
+
+	readErrs := make(chan error, 1)
+	go func() {
+		readErrs <- s.serve(conn)
+	}()
+
+	close(ready)
+
+	select {
+	case <-signals:
+		conn.Close()
+		return nil
+	case err := <-readErrs:
+		return err
+	}
+}
+
+func (s *Server) serve(conn net.PacketConn) error {
+	logger := s.Logger.Session("udp-echo")
+	trains := make(map[uint64]*trainState)
+	trainsLock := &sync.Mutex{}
+	buffer := make([]byte, 64<<10)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(trainIdleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				trainsLock.Lock()
+				for id, t := range trains {
+					if now.Sub(t.lastSeen) > trainIdleTimeout {
+						delete(trains, id)
+					}
+				}
+				trainsLock.Unlock()
+			}
+		}
+	}()
+
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+
+		if udpAddr, ok := addr.(*net.UDPAddr); !ok || !s.AllowedCIDR.Contains(udpAddr.IP) {
+			logger.Debug("peer-not-allowed", lager.Data{"remote-addr": addr.String()})
+			continue
+		}
+
+		p, err := unmarshal(buffer[:n])
+		if err != nil {
+			logger.Debug("bad-datagram", lager.Data{"remote-addr": addr.String(), "error": err.Error()})
+			continue
+		}
+
+		// MTU probes only need to arrive, so the echo is just the header
+		if p.Kind == kindMTU {
+			p.Echoed = now.UnixNano()
+			p.putHeader(buffer)
+			if _, err := conn.WriteTo(buffer[:MinPacketSize], addr); err != nil {
+				logger.Debug("echo-failed", lager.Data{"remote-addr": addr.String(), "error": err.Error()})
+			}
+			continue
+		}
+
+		if p.Seq >= MaxTrainLength {
+			logger.Debug("train-too-long", lager.Data{"remote-addr": addr.String(), "seq": p.Seq})
+			continue
+		}
+
+		trainsLock.Lock()
+		train, ok := trains[p.Train]
+		if !ok && len(trains) >= maxTrains {
+			trainsLock.Unlock()
+			logger.Debug("too-many-trains", lager.Data{"remote-addr": addr.String()})
+			continue
+		}
+		if !ok {
+			train = &trainState{arrivals: newArrivals()}
+			trains[p.Train] = train
+		}
+		train.lastSeen = now
+
+		if p.Kind == kindProbe {
+			train.add(p.Seq, p.Sent, now.UnixNano())
+		}
+
+		p.Echoed = time.Now().UnixNano()
+		p.Received = train.received
+		p.Reordered = train.reordered
+		p.Duplicates = train.duplicates
+		p.Jitter = int64(train.jitter)
+		trainsLock.Unlock()
+		p.putHeader(buffer)
+
+		if _, err := conn.WriteTo(buffer[:n], addr); err != nil {
+			logger.Debug("echo-failed", lager.Data{"remote-addr": addr.String(), "error": err.Error()})
+		}
+	}
+}